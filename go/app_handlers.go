@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -62,31 +63,23 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now()
+
 	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
+	signupCampaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnSignup)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	// 招待コードを使った登録
-	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
-		if err != nil {
+	for _, campaign := range signupCampaigns {
+		if err := issueCampaignCoupon(ctx, tx, &campaign, userID, campaign.couponCode(""), now); err != nil && !errors.Is(err, errCampaignUnavailable) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
+	}
 
+	// 招待コードを使った登録
+	if req.InvitationCode != nil && *req.InvitationCode != "" {
 		// ユーザーチェック
 		var inviter User
 		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
@@ -99,26 +92,53 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 招待クーポン付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
+		// 同一人物が別アカウントを作って自分を招待するのを防ぐ
+		if inviter.Firstname == req.FirstName && inviter.Lastname == req.LastName && inviter.DateOfBirth == req.DateOfBirth {
+			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+			return
+		}
+
+		// 退会済みユーザーの招待コードは使えない
+		var inviterDeactivated bool
+		if err := tx.GetContext(ctx, &inviterDeactivated, "SELECT EXISTS (SELECT 1 FROM user_deactivations WHERE user_id = ?)", inviter.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if inviterDeactivated {
+			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+			return
+		}
+
+		// 招待クーポン付与。招待数の上限はキャンペーンの max_redemptions でチェックされる
+		invitationCampaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnInvitation)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		for _, campaign := range invitationCampaigns {
+			if err := issueCampaignCoupon(ctx, tx, &campaign, userID, campaign.couponCode(*req.InvitationCode), now); err != nil {
+				if errors.Is(err, errCampaignUnavailable) {
+					writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
 		// 招待した人にもRewardを付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
+		rewardCampaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnInvitationReward)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		for _, campaign := range rewardCampaigns {
+			code := campaign.couponCode(fmt.Sprintf("%s_%d", *req.InvitationCode, now.UnixMilli()))
+			if err := issueCampaignCoupon(ctx, tx, &campaign, inviter.ID, code, now); err != nil && !errors.Is(err, errCampaignUnavailable) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -183,6 +203,7 @@ type getAppRidesResponseItem struct {
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
+	Measured              *rideMeasurementResponse     `json:"measured"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -241,6 +262,13 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
 		}
 
+		measurement, err := getRideMeasurement(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		item.Measured = newRideMeasurementResponse(measurement)
+
 		item.Chair = getAppRidesResponseItemChair{}
 
 		chair := &Chair{}
@@ -275,6 +303,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	CouponCode            *string     `json:"coupon_code"`
 }
 
 type appPostRidesResponse struct {
@@ -339,6 +368,10 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateRideCoordinates(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
@@ -392,77 +425,42 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
+	coupon, campaign, err := chooseCoupon(ctx, tx, user.ID, req.CouponCode, time.Now(), true)
+	if err != nil {
+		if errors.Is(err, errCouponUnavailable) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
+	if coupon != nil {
+		result, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ? AND used_by IS NULL",
+			rideID, user.ID, coupon.Code,
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
 		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
+		if count, err := result.RowsAffected(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		} else if count == 0 {
+			// 他のリクエストで先に使われていた
+			coupon, campaign = nil, nil
 		}
 	}
 
-	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
+	// 後から領収書などで参照できるように、運賃の内訳を保存しておく
+	rideFare := calculateFareBreakdown(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, coupon, campaign)
+	rideFare.RideID = rideID
+	if err := insertRideFare(ctx, tx, &rideFare); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	fare := rideFare.Fare
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -483,6 +481,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	CouponCode            *string     `json:"coupon_code"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
@@ -501,6 +500,10 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateRideCoordinates(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 
@@ -511,11 +514,16 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	coupon, campaign, err := chooseCoupon(ctx, tx, user.ID, req.CouponCode, time.Now(), false)
 	if err != nil {
+		if errors.Is(err, errCouponUnavailable) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	discounted := calculateFareWithCoupon(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, coupon, campaign)
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -540,11 +548,13 @@ func abs(a int) int {
 }
 
 type appPostRideEvaluationRequest struct {
-	Evaluation int `json:"evaluation"`
+	Evaluation int  `json:"evaluation"`
+	Tip        *int `json:"tip"`
 }
 
 type appPostRideEvaluationResponse struct {
-	CompletedAt int64 `json:"completed_at"`
+	CompletedAt int64   `json:"completed_at"`
+	TipStatus   *string `json:"tip_status,omitempty"`
 }
 
 func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
@@ -560,6 +570,10 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
 		return
 	}
+	if req.Tip != nil && (*req.Tip < 1 || *req.Tip > maxTipAmount) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("tip must be between 1 and %d", maxTipAmount))
+		return
+	}
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -633,6 +647,10 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := applyMeasuredFare(ctx, tx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -648,13 +666,10 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
-		}
-		return rides, nil
+	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() (int, error) {
+		return countExpectedPayments(ctx, tx, ride.UserID, 0)
 	}); err != nil {
+		recordFailedRidePayment(tx, ride.ID, paymentKindFare, fare, paymentToken.Token)
 		if errors.Is(err, erroredUpstream) {
 			writeError(w, http.StatusBadGateway, err)
 			return
@@ -663,11 +678,47 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := recordRidePayment(ctx, tx, ride.ID, paymentKindFare, fare, paymentToken.Token, paymentStatusSucceeded); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := addRideToHourlySales(ctx, tx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	chairIndex.SetBusy(ride.ChairID.String, false)
+
+	if err := applyPendingChairDeactivation(ctx, ride.ChairID.String); err != nil {
+		log.Printf("failed to apply pending chair deactivation: %v", err)
+	}
+	// 評価の集計は応答を待たせないように裏で行う
+	go func(chairID string) {
+		if err := checkChairRatingAlert(context.Background(), chairID); err != nil {
+			log.Printf("failed to check rating alert: %v", err)
+		}
+	}(ride.ChairID.String)
+
+	res := &appPostRideEvaluationResponse{
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	}
+
+	// 運賃の決済は確定しているので、チップの決済に失敗しても評価は成功として返す
+	if req.Tip != nil {
+		tipStatus := paymentStatusSucceeded
+		if err := chargeTip(ctx, ride, *req.Tip); err != nil {
+			log.Printf("failed to charge tip: %v", err)
+			tipStatus = paymentStatusFailed
+		}
+		res.TipStatus = &tipStatus
+	}
+
 	user := &User{}
 	err = db.GetContext(context.Background(), user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
 	if err != nil {
@@ -679,9 +730,72 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: ride.UpdatedAt.UnixMilli(),
-	})
+	writeJSON(w, http.StatusOK, res)
+}
+
+type appPostRideTipRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 評価の後からチップを送る
+func appPostRideTip(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	req := &appPostRideTipRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Amount < 1 || req.Amount > maxTipAmount {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("amount must be between 1 and %d", maxTipAmount))
+		return
+	}
+
+	ride := &Ride{}
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := getLatestRideStatus(ctx, db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("ride is not completed yet"))
+		return
+	}
+	completedAt, err := getRideCompletedAt(ctx, db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if time.Since(completedAt) > tipWindow {
+		writeError(w, http.StatusBadRequest, errors.New("tip window has passed"))
+		return
+	}
+
+	if err := chargeTip(ctx, ride, req.Amount); err != nil {
+		switch {
+		case errors.Is(err, errTipAlreadyPaid):
+			writeError(w, http.StatusConflict, err)
+		case errors.Is(err, errPaymentTokenNotRegistered):
+			writeError(w, http.StatusBadRequest, err)
+		case errors.Is(err, erroredUpstream):
+			writeError(w, http.StatusBadGateway, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 type appGetNotificationResponse struct {
@@ -918,6 +1032,7 @@ func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNoti
 type appGetNearbyChairsResponse struct {
 	Chairs      []appGetNearbyChairsResponseChair `json:"chairs"`
 	RetrievedAt int64                             `json:"retrieved_at"`
+	NextOffset  *int                              `json:"next_offset,omitempty"`
 }
 
 type appGetNearbyChairsResponseChair struct {
@@ -925,6 +1040,7 @@ type appGetNearbyChairsResponseChair struct {
 	Name              string     `json:"name"`
 	Model             string     `json:"model"`
 	CurrentCoordinate Coordinate `json:"current_coordinate"`
+	Distance          int        `json:"distance"`
 }
 
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
@@ -960,94 +1076,68 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
-	chairsQuery := `
-        SELECT c.id, c.name, c.model, cl.latitude, cl.longitude
-        FROM chairs c
-        JOIN latest_chair_locations cl ON c.id = cl.chair_id
-        WHERE c.is_active = 1
-    `
-
-	chairs := []struct {
-		ID        string `db:"id"`
-		Name      string `db:"name"`
-		Model     string `db:"model"`
-		Latitude  int    `db:"latitude"`
-		Longitude int    `db:"longitude"`
-	}{}
-
-	err = db.SelectContext(ctx, &chairs, chairsQuery)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if len(chairs) == 0 {
-		writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
-			Chairs:      []appGetNearbyChairsResponseChair{},
-			RetrievedAt: time.Now().UnixMilli(),
-		})
-		return
-	}
-
-	chairIDs := make([]string, len(chairs))
-	for i, chair := range chairs {
-		chairIDs[i] = chair.ID
-	}
-
-	ridesQuery := `
-        SELECT r.chair_id, lrs.status
-        FROM rides r
-        JOIN latest_ride_statuses lrs ON r.id = lrs.ride_id
-        WHERE r.chair_id IN (?)
-    `
-	query, args, err := sqlx.In(ridesQuery, chairIDs)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 近い順に並んだ結果を offset から limit 件返す。limit の指定が無ければ範囲内の全てを返す
+	offset := 0
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("offset is invalid"))
+			return
+		}
 	}
-	query = db.Rebind(query)
-
-	rideStatuses := []struct {
-		ChairID string `db:"chair_id"`
-		Status  string `db:"status"`
-	}{}
-
-	err = db.SelectContext(ctx, &rideStatuses, query, args...)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit is invalid"))
+			return
+		}
 	}
 
-	chairStatusMap := make(map[string][]string)
-	for _, rs := range rideStatuses {
-		chairStatusMap[rs.ChairID] = append(chairStatusMap[rs.ChairID], rs.Status)
+	found := chairIndex.Search(coordinate.Latitude, coordinate.Longitude, distance)
+	page := found[min(offset, len(found)):]
+	var nextOffset *int
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		next := offset + limit
+		nextOffset = &next
 	}
 
 	nearbyChairs := []appGetNearbyChairsResponseChair{}
-	for _, chair := range chairs {
-		statuses, exists := chairStatusMap[chair.ID]
-		if exists {
-			hasOngoingRide := false
-			for _, status := range statuses {
-				if status != "COMPLETED" {
-					hasOngoingRide = true
-					break
-				}
-			}
-			if hasOngoingRide {
-				continue
-			}
+	if len(page) > 0 {
+		chairIDs := make([]string, len(page))
+		for i, e := range page {
+			chairIDs[i] = e.ChairID
+		}
+		query, args, err := sqlx.In("SELECT * FROM chairs WHERE id IN (?)", chairIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		chairs := []Chair{}
+		if err := db.SelectContext(ctx, &chairs, db.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		chairByID := make(map[string]*Chair, len(chairs))
+		for i := range chairs {
+			chairByID[chairs[i].ID] = &chairs[i]
 		}
 
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, chair.Latitude, chair.Longitude) <= distance {
+		for _, e := range page {
+			chair, ok := chairByID[e.ChairID]
+			if !ok {
+				continue
+			}
 			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
 				ID:    chair.ID,
 				Name:  chair.Name,
 				Model: chair.Model,
 				CurrentCoordinate: Coordinate{
-					Latitude:  chair.Latitude,
-					Longitude: chair.Longitude,
+					Latitude:  e.Latitude,
+					Longitude: e.Longitude,
 				},
+				Distance: e.Distance,
 			})
 		}
 	}
@@ -1057,6 +1147,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
 		Chairs:      nearbyChairs,
 		RetrievedAt: retrievedAt,
+		NextOffset:  nextOffset,
 	})
 }
 func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
@@ -1065,44 +1156,408 @@ func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude
 }
 
 func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
+	var (
+		coupon   *Coupon
+		campaign *Campaign
+		err      error
+	)
 	if ride != nil {
 		destLatitude = ride.DestinationLatitude
 		destLongitude = ride.DestinationLongitude
 		pickupLatitude = ride.PickupLatitude
 		pickupLongitude = ride.PickupLongitude
 
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
+		// 運賃の内訳が保存されていればそれを使う
+		rideFare, err := getRideFare(ctx, tx, ride.ID)
+		if err != nil {
+			return 0, err
+		}
+		if rideFare != nil {
+			return rideFare.Fare, nil
 		}
+
+		// すでにクーポンが紐づいているならそれの割引額を参照
+		coupon, campaign, err = getRideCoupon(ctx, tx, ride.ID)
 	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
+		// 紐づけ前なら、ライド作成時に選ばれるのと同じクーポンを使う
+		coupon, campaign, err = selectCoupon(ctx, tx, userID, time.Now(), false)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return calculateFareWithCoupon(pickupLatitude, pickupLongitude, destLatitude, destLongitude, coupon, campaign), nil
+}
+
+func calculateFareWithCoupon(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, coupon *Coupon, campaign *Campaign) int {
+	return calculateFareBreakdown(pickupLatitude, pickupLongitude, destLatitude, destLongitude, coupon, campaign).Fare
+}
+
+type appCoupon struct {
+	Code         string  `json:"code"`
+	CampaignName string  `json:"campaign_name"`
+	DiscountType string  `json:"discount_type"`
+	Discount     int     `json:"discount"`
+	DiscountCap  *int    `json:"discount_cap,omitempty"`
+	Status       string  `json:"status"`
+	UsedBy       *string `json:"used_by,omitempty"`
+	GrantedAt    int64   `json:"granted_at"`
+	ExpiresAt    *int64  `json:"expires_at,omitempty"`
+}
+
+func newAppCoupon(coupon *Coupon, campaign *Campaign, now time.Time) appCoupon {
+	c := appCoupon{
+		Code:         coupon.Code,
+		DiscountType: discountTypeFixed,
+		Discount:     coupon.Discount,
+		Status:       couponStatus(coupon, campaign, now),
+		UsedBy:       coupon.UsedBy,
+		GrantedAt:    coupon.CreatedAt.UnixMilli(),
+	}
+	if campaign != nil {
+		c.CampaignName = campaign.Name
+		c.DiscountType = campaign.DiscountType
+		c.DiscountCap = campaign.DiscountCap
+		if campaign.DiscountType == discountTypePercent {
+			c.Discount = campaign.DiscountValue
+		}
+		if campaign.EndsAt != nil {
+			t := campaign.EndsAt.UnixMilli()
+			c.ExpiresAt = &t
+		}
+	}
+	return c
+}
+
+type appGetCouponsResponse struct {
+	Coupons []appCoupon `json:"coupons"`
+}
+
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE user_id = ? ORDER BY created_at", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	campaigns, err := getCampaigns(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	res := appGetCouponsResponse{Coupons: []appCoupon{}}
+	for _, coupon := range coupons {
+		res.Coupons = append(res.Coupons, newAppCoupon(&coupon, findCampaignForCode(campaigns, coupon.Code), now))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type appPostCouponsRequest struct {
+	Code string `json:"code"`
+}
+
+// プロモーションコードを入力してクーポンを受け取る
+func appPostCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostCouponsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Code == "" {
+		writeError(w, http.StatusBadRequest, errors.New("code is required but was empty"))
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnPromo)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	campaign := findCampaignForCode(campaigns, req.Code)
+	if campaign == nil {
+		writeError(w, http.StatusNotFound, errors.New("promo code not found"))
+		return
+	}
+
+	var owned int
+	if err := tx.GetContext(ctx, &owned, "SELECT COUNT(*) FROM coupons WHERE user_id = ? AND code = ?", user.ID, req.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if owned > 0 {
+		writeError(w, http.StatusConflict, errors.New("promo code already redeemed"))
+		return
+	}
+	// 前方一致のキャンペーンではコードを変えれば何度でも登録できてしまうので、
+	// ユーザーごとの上限が無ければキャンペーンにつき1回までとする
+	if campaign.PerUserLimit == nil {
+		redeemed, err := countUserCampaignCoupons(ctx, tx, campaign, user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if redeemed > 0 {
+			writeError(w, http.StatusConflict, errors.New("promo code of this campaign already redeemed"))
+			return
+		}
+	}
+
+	now := time.Now()
+	if err := issueCampaignCoupon(ctx, tx, campaign, user.ID, req.Code, now); err != nil {
+		if errors.Is(err, errCampaignUnavailable) {
+			writeError(w, http.StatusBadRequest, errors.New("promo code is not available"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	coupon := &Coupon{}
+	if err := tx.GetContext(ctx, coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = ?", user.ID, req.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAppCoupon(coupon, campaign, now))
+}
+
+type appGetReferralsResponse struct {
+	InvitationCode string                           `json:"invitation_code"`
+	Invitees       []appGetReferralsResponseInvitee `json:"invitees"`
+	Rewards        appGetReferralsResponseRewards   `json:"rewards"`
+	RemainingSlots *int                             `json:"remaining_slots"`
+}
+
+type appGetReferralsResponseInvitee struct {
+	Username  string `json:"username"`
+	InvitedAt int64  `json:"invited_at"`
+}
+
+type appGetReferralsResponseRewards struct {
+	Count         int `json:"count"`
+	UsedCount     int `json:"used_count"`
+	TotalDiscount int `json:"total_discount"`
+}
+
+// 招待の状況は、招待キャンペーン・招待報酬キャンペーンで付与されたクーポンから組み立てる
+func appGetReferrals(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	res := appGetReferralsResponse{
+		InvitationCode: user.InvitationCode,
+		Invitees:       []appGetReferralsResponseInvitee{},
+	}
+
+	invitationCampaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnInvitation)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, campaign := range invitationCampaigns {
+		invitees := []struct {
+			Username  string    `db:"username"`
+			CreatedAt time.Time `db:"created_at"`
+		}{}
+		if err := tx.SelectContext(
+			ctx,
+			&invitees,
+			"SELECT users.username, coupons.created_at FROM coupons JOIN users ON users.id = coupons.user_id WHERE coupons.code = ? ORDER BY coupons.created_at",
+			campaign.couponCode(user.InvitationCode),
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, invitee := range invitees {
+			res.Invitees = append(res.Invitees, appGetReferralsResponseInvitee{
+				Username:  invitee.Username,
+				InvitedAt: invitee.CreatedAt.UnixMilli(),
+			})
+		}
+
+		if campaign.MaxRedemptions != nil {
+			remaining := max(*campaign.MaxRedemptions-len(invitees), 0)
+			if res.RemainingSlots == nil || remaining < *res.RemainingSlots {
+				res.RemainingSlots = &remaining
 			}
+		}
+	}
 
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
+	rewardCampaigns, err := getCampaignsByGrantOn(ctx, tx, campaignGrantOnInvitationReward)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE user_id = ?", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, coupon := range coupons {
+		for _, campaign := range rewardCampaigns {
+			if !strings.HasPrefix(coupon.Code, campaign.couponCode(user.InvitationCode+"_")) {
+				continue
 			}
-		} else {
-			discount = coupon.Discount
+			res.Rewards.Count++
+			res.Rewards.TotalDiscount += coupon.Discount
+			if coupon.UsedBy != nil {
+				res.Rewards.UsedCount++
+			}
+			break
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func appGetRideReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? AND user_id = ?`, rideID, user.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status != "COMPLETED" {
+		writeError(w, http.StatusBadRequest, errors.New("ride is not completed yet"))
+		return
+	}
+
+	rideFare, err := getRideFare(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rideFare == nil {
+		writeError(w, http.StatusNotFound, errors.New("receipt is not available for this ride"))
+		return
+	}
+
+	payment, err := getRidePayment(ctx, tx, ride.ID, paymentKindFare)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tip, err := getRidePayment(ctx, tx, ride.ID, paymentKindTip)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	owner := &Owner{}
+	if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	receipt := &rideReceipt{
+		RideID: ride.ID,
+		Chair: rideReceiptChair{
+			Name:  chair.Name,
+			Model: chair.Model,
+			Owner: owner.Name,
+		},
+		PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+		RequestedAt:           ride.CreatedAt.UnixMilli(),
+		CompletedAt:           ride.UpdatedAt.UnixMilli(),
+		BaseFare:              rideFare.BaseFare,
+		Distance:              rideFare.Distance,
+		DistanceBasis:         rideFare.DistanceBasis,
+		FarePerDistance:       rideFare.FarePerDistance,
+		MeteredFare:           rideFare.MeteredFare,
+		CouponCode:            rideFare.CouponCode,
+		Discount:              rideFare.Discount,
+		Surcharge:             rideFare.Surcharge,
+		Fare:                  rideFare.Fare,
+	}
+	if payment != nil {
+		receipt.Payment = newRideReceiptPayment(payment)
+	}
+	if tip != nil {
+		receipt.Tip = newRideReceiptPayment(tip)
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(receipt.text()))
+		return
+	}
 
-	return initialFare + discountedMeteredFare, nil
+	writeJSON(w, http.StatusOK, receipt)
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	campaignGrantOnSignup           = "signup"
+	campaignGrantOnInvitation       = "invitation"
+	campaignGrantOnInvitationReward = "invitation_reward"
+	campaignGrantOnPromo            = "promo"
+
+	discountTypeFixed   = "fixed"
+	discountTypePercent = "percent"
+
+	couponStatusAvailable   = "available"
+	couponStatusUsed        = "used"
+	couponStatusExpired     = "expired"
+	couponStatusNotStarted  = "not_started"
+	couponStatusUnavailable = "unavailable"
+)
+
+var (
+	errCampaignUnavailable = errors.New("campaign is not available")
+	errCouponUnavailable   = errors.New("coupon is not available")
+)
+
+// コードがキャンペーンのパターンに一致するか。末尾の * は前方一致
+func (c *Campaign) matches(code string) bool {
+	if prefix, ok := strings.CutSuffix(c.CodePattern, "*"); ok {
+		return strings.HasPrefix(code, prefix)
+	}
+	return c.CodePattern == code
+}
+
+// パターンからクーポンコードを組み立てる。固定コードのキャンペーンでは suffix は無視される
+func (c *Campaign) couponCode(suffix string) string {
+	if prefix, ok := strings.CutSuffix(c.CodePattern, "*"); ok {
+		return prefix + suffix
+	}
+	return c.CodePattern
+}
+
+func (c *Campaign) isActiveAt(t time.Time) bool {
+	if c.StartsAt != nil && t.Before(*c.StartsAt) {
+		return false
+	}
+	if c.EndsAt != nil && !t.Before(*c.EndsAt) {
+		return false
+	}
+	return true
+}
+
+func getCampaigns(ctx context.Context, tx *sqlx.Tx) ([]Campaign, error) {
+	campaigns := []Campaign{}
+	if err := tx.SelectContext(ctx, &campaigns, "SELECT * FROM campaigns ORDER BY priority DESC, created_at ASC"); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+func getCampaignsByGrantOn(ctx context.Context, tx *sqlx.Tx, grantOn string) ([]Campaign, error) {
+	campaigns := []Campaign{}
+	if err := tx.SelectContext(ctx, &campaigns, "SELECT * FROM campaigns WHERE grant_on = ? ORDER BY priority DESC, created_at ASC", grantOn); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+// 優先度順に並んだキャンペーンから、コードに一致する最初のものを返す
+func findCampaignForCode(campaigns []Campaign, code string) *Campaign {
+	for i := range campaigns {
+		if campaigns[i].matches(code) {
+			return &campaigns[i]
+		}
+	}
+	return nil
+}
+
+// ユーザーが持っている、キャンペーンのパターンに一致するクーポンの数。前方一致のキャンペーンでは異なるコードもまとめて数える
+func countUserCampaignCoupons(ctx context.Context, tx *sqlx.Tx, campaign *Campaign, userID string) (int, error) {
+	var codes []string
+	if err := tx.SelectContext(ctx, &codes, "SELECT code FROM coupons WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		return 0, err
+	}
+	owned := 0
+	for _, c := range codes {
+		if campaign.matches(c) {
+			owned++
+		}
+	}
+	return owned, nil
+}
+
+// キャンペーンのクーポンを付与する。有効期間外や付与上限に達している場合は errCampaignUnavailable を返す
+func issueCampaignCoupon(ctx context.Context, tx *sqlx.Tx, campaign *Campaign, userID string, code string, now time.Time) error {
+	if !campaign.isActiveAt(now) {
+		return errCampaignUnavailable
+	}
+
+	if campaign.MaxRedemptions != nil {
+		var redemptions int
+		if err := tx.GetContext(ctx, &redemptions, "SELECT COUNT(*) FROM coupons WHERE code = ? FOR UPDATE", code); err != nil {
+			return err
+		}
+		if redemptions >= *campaign.MaxRedemptions {
+			return errCampaignUnavailable
+		}
+	}
+
+	if campaign.PerUserLimit != nil {
+		owned, err := countUserCampaignCoupons(ctx, tx, campaign, userID)
+		if err != nil {
+			return err
+		}
+		if owned >= *campaign.PerUserLimit {
+			return errCampaignUnavailable
+		}
+	}
+
+	// 定率割引は運賃が決まるまで割引額が決まらないので 0 を入れておく
+	discount := 0
+	if campaign.DiscountType == discountTypeFixed {
+		discount = campaign.DiscountValue
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO coupons (user_id, code, discount, created_at) VALUES (?, ?, ?, ?)",
+		userID, code, discount, now,
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 未使用のクーポンの中から、キャンペーンの優先度が高く、付与が古いものを選ぶ。
+// lock なら選んだクーポンを使うまで他のリクエストに選ばれないようにロックする。他のリクエストがロックしているクーポンは飛ばす
+func selectCoupon(ctx context.Context, tx *sqlx.Tx, userID string, now time.Time, lock bool) (*Coupon, *Campaign, error) {
+	query := "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at"
+	if lock {
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, query, userID); err != nil {
+		return nil, nil, err
+	}
+	if len(coupons) == 0 {
+		return nil, nil, nil
+	}
+
+	campaigns, err := getCampaigns(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type candidate struct {
+		coupon   *Coupon
+		campaign *Campaign
+	}
+	candidates := make([]candidate, 0, len(coupons))
+	for i := range coupons {
+		campaign := findCampaignForCode(campaigns, coupons[i].Code)
+		if campaign == nil || !campaign.isActiveAt(now) {
+			continue
+		}
+		candidates = append(candidates, candidate{coupon: &coupons[i], campaign: campaign})
+	}
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].campaign.Priority > candidates[j].campaign.Priority
+	})
+	return candidates[0].coupon, candidates[0].campaign, nil
+}
+
+// 指定されたコードの未使用クーポンを、今使えるものであれば返す。
+// lock なら他のリクエストが使い終わるのを待ってから読むので、先に使われていれば使えないクーポンになる
+func getUsableCoupon(ctx context.Context, tx *sqlx.Tx, userID string, code string, now time.Time, lock bool) (*Coupon, *Campaign, error) {
+	query := "SELECT * FROM coupons WHERE user_id = ? AND code = ? AND used_by IS NULL"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	coupon := &Coupon{}
+	if err := tx.GetContext(ctx, coupon, query, userID, code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, errCouponUnavailable
+		}
+		return nil, nil, err
+	}
+
+	campaigns, err := getCampaigns(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	campaign := findCampaignForCode(campaigns, coupon.Code)
+	if campaign == nil || !campaign.isActiveAt(now) {
+		return nil, nil, errCouponUnavailable
+	}
+	return coupon, campaign, nil
+}
+
+// コードの指定があればそのクーポンを、無ければ自動で選んだクーポンを使う。ライドに使うときは lock を true にする
+func chooseCoupon(ctx context.Context, tx *sqlx.Tx, userID string, code *string, now time.Time, lock bool) (*Coupon, *Campaign, error) {
+	if code != nil && *code != "" {
+		return getUsableCoupon(ctx, tx, userID, *code, now, lock)
+	}
+	return selectCoupon(ctx, tx, userID, now, lock)
+}
+
+// ライドに紐づいているクーポンを返す。キャンペーンが見つからない古いクーポンは campaign が nil になる
+func getRideCoupon(ctx context.Context, tx *sqlx.Tx, rideID string) (*Coupon, *Campaign, error) {
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE used_by = ? LIMIT 1", rideID); err != nil {
+		return nil, nil, err
+	}
+	if len(coupons) == 0 {
+		return nil, nil, nil
+	}
+
+	campaigns, err := getCampaigns(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &coupons[0], findCampaignForCode(campaigns, coupons[0].Code), nil
+}
+
+// 距離運賃に対する割引額を求める
+func calculateCouponDiscount(coupon *Coupon, campaign *Campaign, meteredFare int) int {
+	if coupon == nil {
+		return 0
+	}
+	if campaign == nil || campaign.DiscountType == discountTypeFixed {
+		return coupon.Discount
+	}
+
+	discount := meteredFare * campaign.DiscountValue / 100
+	if campaign.DiscountCap != nil {
+		discount = min(discount, *campaign.DiscountCap)
+	}
+	return discount
+}
+
+func couponStatus(coupon *Coupon, campaign *Campaign, now time.Time) string {
+	switch {
+	case coupon.UsedBy != nil:
+		return couponStatusUsed
+	case campaign == nil:
+		return couponStatusUnavailable
+	case campaign.EndsAt != nil && !now.Before(*campaign.EndsAt):
+		return couponStatusExpired
+	case campaign.StartsAt != nil && now.Before(*campaign.StartsAt):
+		return couponStatusNotStarted
+	default:
+		return couponStatusAvailable
+	}
+}
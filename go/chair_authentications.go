@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// 同じ接続元からの認証は、前の記録からこの時間が経つまで記録しない
+	chairAuthenticationRecordInterval = time.Minute
+	// これより古い認証の記録は消す
+	chairAuthenticationRetention     = 24 * time.Hour
+	chairAuthenticationSweepInterval = 10 * time.Minute
+	maxChairAuthentications          = 1000
+)
+
+// 椅子ごとに最後に記録した認証。chairID -> chairAuthentication
+var chairAuthentications sync.Map
+
+type chairAuthentication struct {
+	RemoteAddr      string
+	AuthenticatedAt time.Time
+}
+
+// 椅子の認証を記録する。リクエストのたびに書き込まないように、接続元が変わったときと一定時間ごとにだけ記録する
+func recordChairAuthentication(ctx context.Context, chairID string, remoteAddr string, at time.Time) error {
+	if v, ok := chairAuthentications.Load(chairID); ok {
+		last := v.(chairAuthentication)
+		if last.RemoteAddr == remoteAddr && at.Sub(last.AuthenticatedAt) < chairAuthenticationRecordInterval {
+			return nil
+		}
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO chair_authentications (id, chair_id, remote_addr, authenticated_at) VALUES (?, ?, ?, ?)",
+		ulid.Make().String(), chairID, remoteAddr, at,
+	); err != nil {
+		return err
+	}
+	chairAuthentications.Store(chairID, chairAuthentication{RemoteAddr: remoteAddr, AuthenticatedAt: at})
+	return nil
+}
+
+func sweepChairAuthentications() {
+	if _, err := db.ExecContext(
+		context.Background(),
+		"DELETE FROM chair_authentications WHERE authenticated_at < ?",
+		time.Now().Add(-chairAuthenticationRetention),
+	); err != nil {
+		log.Printf("failed to sweep chair authentications: %v", err)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -85,34 +84,81 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
 
-	w.WriteHeader(http.StatusNoContent)
-}
-
-var (
-	chairLocationMutex = sync.Mutex{}
-	chairLocations     = make([]ChairLocation, 0)
-)
-
-func InsertChairLocations() {
-	if len(chairLocations) == 0 {
+	// 勤務時間の上限による受付停止と重ならないように椅子をロックする
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	chairLocationMutex.Lock()
-	jobs := chairLocations
-	chairLocations = make([]ChairLocation, 0)
-	chairLocationMutex.Unlock()
+	now := time.Now()
+	if req.IsActive {
+		// ライドの途中で要求していた受付停止は取り消す。勤務時間の上限による停止は取り消せない
+		if _, err := tx.ExecContext(ctx, "DELETE FROM chair_pending_deactivations WHERE chair_id = ? AND reason = ?", chair.ID, chairPendingDeactivationRequested); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		limit, err := getOwnerShiftLimit(ctx, tx, chair.OwnerID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		reached, err := chairShiftLimitReached(ctx, tx, chair.ID, limit, now)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if reached {
+			writeError(w, http.StatusConflict, fmt.Errorf("chair must take a break of at least %d minutes", limit.MinBreakMinutes))
+			return
+		}
+		if err := startChairShift(ctx, tx, chair.ID, now); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		// ライドの途中なら、ライドが終わってから受付停止にする
+		busy, err := chairHasActiveRide(ctx, tx, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// 受付停止を待っていることは、オーナーの椅子の詳細の pending_deactivation で分かる
+		if busy {
+			if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO chair_pending_deactivations (chair_id) VALUES (?)", chair.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := endChairShift(ctx, tx, chair.ID, now, chairShiftEndReasonDeactivated); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
-	if _, err := db.NamedExec(`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :created_at)`, jobs); err != nil {
-		log.Printf("failed to insert chair location: %v", err)
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairIndex.SetActive(chair.ID, req.IsActive)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 type chairPostCoordinateResponse struct {
@@ -135,6 +181,25 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		Longitude: req.Longitude,
 		CreatedAt: time.Now(),
 	}
+	// 書き込みが追いついていないときは、椅子に少し待ってから送り直してもらう
+	if err := chairLocationQueue.Reserve(); err != nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	// ライドの状態の更新に失敗したときは椅子が送り直すので、位置は記録しない
+	enqueued := false
+	defer func() {
+		if !enqueued {
+			chairLocationQueue.Release()
+		}
+	}()
+	_, moved := updateChairLocation(l.ChairID, l.Latitude, l.Longitude, l.CreatedAt)
+	if err := checkChairArea(ctx, l.ChairID, *req, l.CreatedAt); err != nil {
+		log.Printf("failed to check service area of chair %s: %v", l.ChairID, err)
+	}
+
+	notifyUserID := ""
 	ride := &Ride{}
 	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, l.ChairID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
@@ -148,12 +213,24 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if status != "COMPLETED" && status != "CANCELED" {
+			// 配車位置に向かう間と目的地に向かう間の移動を、ライドの実測距離として記録する
+			if (status == "ENROUTE" || status == "CARRYING") && moved > 0 {
+				if err := addRideMeasuredDistance(ctx, ride.ID, status, moved); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
 			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
 				if _, err := db.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
 					writeError(w, http.StatusInternalServerError, err)
 					return
 				}
 				setLatestChairStatusNotSent(ride.ChairID.String, "PICKUP")
+				if err := finishRideMeasuredLeg(ctx, ride.ID, "ENROUTE", l.CreatedAt); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
 			}
 
 			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
@@ -162,24 +239,30 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 				setLatestChairStatusNotSent(ride.ChairID.String, "ARRIVED")
+				if err := finishRideMeasuredLeg(ctx, ride.ID, "CARRYING", l.CreatedAt); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
 			}
 
-			user := &User{}
-			err = db.GetContext(context.Background(), user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
-			if err != nil {
-				log.Printf("failed to get user: %v", err)
-				return
-			}
-			if err := notifyRideStatus(user); err != nil {
-				log.Printf("failed to notify ride status: %v", err)
-				return
-			}
+			notifyUserID = ride.UserID
 		}
 	}
 
-	chairLocationMutex.Lock()
-	chairLocations = append(chairLocations, l)
-	chairLocationMutex.Unlock()
+	chairLocationQueue.Enqueue(l)
+	enqueued = true
+
+	if notifyUserID != "" {
+		user := &User{}
+		if err := db.GetContext(context.Background(), user, "SELECT * FROM users WHERE id = ? FOR SHARE", notifyUserID); err != nil {
+			log.Printf("failed to get user: %v", err)
+			return
+		}
+		if err := notifyRideStatus(user); err != nil {
+			log.Printf("failed to notify ride status: %v", err)
+			return
+		}
+	}
 
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
 		RecordedAt: l.CreatedAt.UnixMilli(),
@@ -218,6 +301,48 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	yetSentRideStatus := RideStatus{}
 	status := ""
 
+	// 応答が無く取り消された割り当てがあれば、他の通知より先に伝える
+	expired, err := popExpiredRideAssignment(ctx, tx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if expired != nil {
+		if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ?", expired.RideID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		user := &User{}
+		if err := tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+			Data: &chairGetNotificationResponseData{
+				RideID: ride.ID,
+				User: simpleUser{
+					ID:   user.ID,
+					Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+				},
+				PickupCoordinate: Coordinate{
+					Latitude:  ride.PickupLatitude,
+					Longitude: ride.PickupLongitude,
+				},
+				DestinationCoordinate: Coordinate{
+					Latitude:  ride.DestinationLatitude,
+					Longitude: ride.DestinationLongitude,
+				},
+				Status: "REASSIGNED",
+			},
+			RetryAfterMs: 300,
+		})
+		return
+	}
+
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
@@ -288,6 +413,8 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 
 type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
+	// REJECT のときに断った理由
+	Reason string `json:"reason"`
 }
 
 func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
@@ -324,6 +451,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rejected := false
 	switch req.Status {
 	// Acknowledge the ride
 	case "ENROUTE":
@@ -331,7 +459,35 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		if err := respondRideAssignment(ctx, tx, ride.ID, chair.ID, rideAssignmentResultAccepted, nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 		setLatestChairStatusNotSent(chair.ID, "ENROUTE")
+	// Decline the ride. It goes back to matching without this chair
+	case "REJECT":
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, errors.New("reason is required"))
+			return
+		}
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if status != "MATCHING" {
+			writeError(w, http.StatusBadRequest, errors.New("ride has already been accepted"))
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL WHERE id = ?", ride.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := respondRideAssignment(ctx, tx, ride.ID, chair.ID, rideAssignmentResultRejected, &req.Reason); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		rejected = true
 	// After Picking up user
 	case "CARRYING":
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
@@ -350,6 +506,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		setLatestChairStatusNotSent(chair.ID, "CARRYING")
 	default:
 		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -357,6 +514,20 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rejected {
+		busy, err := chairHasActiveRide(ctx, db, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		chairIndex.SetBusy(chair.ID, busy)
+		if !busy {
+			if err := applyPendingChairDeactivation(ctx, chair.ID); err != nil {
+				log.Printf("failed to apply pending chair deactivation: %v", err)
+			}
+		}
+	}
+
 	user := &User{}
 	err = db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
 	if err != nil {
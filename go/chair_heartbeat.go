@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+const chairHeartbeatSweepInterval = 5 * time.Second
+
+// 椅子が何もリクエストしてこなくなってからオフラインとみなすまでの時間
+func getChairOfflineAfter(ctx context.Context, tx executableGet) (time.Duration, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'chair_offline_after_seconds'"); err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// 黙ってしまった椅子をオフラインにし、まだ向かい始めていないライドを配車待ちに戻す
+func sweepOfflineChairs() {
+	ctx := context.Background()
+
+	offlineAfter, err := getChairOfflineAfter(ctx, db)
+	if err != nil {
+		log.Printf("failed to get chair offline threshold: %v", err)
+		return
+	}
+
+	for _, chairID := range chairIndex.MarkOffline(time.Now().Add(-offlineAfter)) {
+		if err := unassignMatchingRides(ctx, chairID); err != nil {
+			log.Printf("failed to reassign rides of offline chair %s: %v", chairID, err)
+		}
+	}
+}
+
+// 椅子に割り当てられたまま MATCHING のライドの割り当てを外し、再びマッチングの対象にする。
+// 割り当ては期限切れとして記録するので、椅子には REASSIGNED が届き、しばらくは同じライドに割り当てない
+func unassignMatchingRides(ctx context.Context, chairID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rides := []Ride{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		"SELECT rides.* FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id WHERE rides.chair_id = ? AND latest_ride_statuses.status = 'MATCHING' FOR UPDATE",
+		chairID,
+	); err != nil {
+		return err
+	}
+	if len(rides) == 0 {
+		return nil
+	}
+	for _, ride := range rides {
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL WHERE id = ?", ride.ID); err != nil {
+			return err
+		}
+		if err := respondRideAssignment(ctx, tx, ride.ID, chairID, rideAssignmentResultTimeout, nil); err != nil {
+			return err
+		}
+	}
+
+	busy, err := chairHasActiveRide(ctx, tx, chairID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	chairIndex.SetBusy(chairID, busy)
+	if !busy {
+		if err := applyPendingChairDeactivation(ctx, chairID); err != nil {
+			log.Printf("failed to apply pending chair deactivation: %v", err)
+		}
+	}
+
+	for _, ride := range rides {
+		user := &User{}
+		if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID); err != nil {
+			return err
+		}
+		if err := notifyRideStatus(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
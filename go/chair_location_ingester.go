@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	chairLocationQueueSize      = 100000
+	chairLocationBatchSize      = 1000
+	chairLocationFlushInterval  = 100 * time.Millisecond
+	chairLocationMaxAttempts    = 5
+	chairLocationRetryBaseDelay = 100 * time.Millisecond
+)
+
+var errChairLocationQueueFull = errors.New("chair location queue is full")
+
+// chair_locations への書き込みをまとめて行うキュー。
+// キューが一杯のときは受け付けずに呼び出し元へ返し、書き込みに失敗したバッチはリトライする
+type chairLocationIngester struct {
+	mu       sync.Mutex
+	queue    []ChairLocation
+	reserved int
+	// 書き込み中のバッチが終わるのを待てるように、書き込みの間は持っておく
+	flushMu sync.Mutex
+
+	notify  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	enqueued      atomic.Int64
+	inserted      atomic.Int64
+	rejected      atomic.Int64
+	dropped       atomic.Int64
+	retries       atomic.Int64
+	failedBatches atomic.Int64
+	lastFlushedAt atomic.Int64
+}
+
+type chairLocationIngesterMetrics struct {
+	QueueDepth    int   `json:"queue_depth"`
+	Reserved      int   `json:"reserved"`
+	QueueSize     int   `json:"queue_size"`
+	Enqueued      int64 `json:"enqueued"`
+	Inserted      int64 `json:"inserted"`
+	Rejected      int64 `json:"rejected"`
+	Dropped       int64 `json:"dropped"`
+	Retries       int64 `json:"retries"`
+	FailedBatches int64 `json:"failed_batches"`
+	LastFlushedAt int64 `json:"last_flushed_at"`
+}
+
+var chairLocationQueue = newChairLocationIngester()
+
+func newChairLocationIngester() *chairLocationIngester {
+	return &chairLocationIngester{
+		queue:   make([]ChairLocation, 0, chairLocationBatchSize),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// キューに空きを1つ確保する。確保したら Enqueue か Release のどちらかを必ず呼ぶこと
+func (q *chairLocationIngester) Reserve() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue)+q.reserved >= chairLocationQueueSize {
+		q.rejected.Add(1)
+		return errChairLocationQueueFull
+	}
+	q.reserved++
+	return nil
+}
+
+func (q *chairLocationIngester) Release() {
+	q.mu.Lock()
+	q.reserved--
+	q.mu.Unlock()
+}
+
+// Reserve で確保した空きに位置を入れる
+func (q *chairLocationIngester) Enqueue(l ChairLocation) {
+	q.mu.Lock()
+	q.reserved--
+	q.queue = append(q.queue, l)
+	full := len(q.queue) >= chairLocationBatchSize
+	q.mu.Unlock()
+	q.enqueued.Add(1)
+
+	// バッチが溜まったら待たずに書き込む
+	if full {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close が呼ばれるまで書き込みを続け、最後にキューに残っているものを全て書き込む
+func (q *chairLocationIngester) Run() {
+	defer close(q.stopped)
+
+	ticker := time.NewTicker(chairLocationFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.flush()
+		case <-q.notify:
+			q.flush()
+		case <-q.done:
+			q.flush()
+			return
+		}
+	}
+}
+
+// Run に書き込みを終えさせ、残りが書き込まれるか ctx が終わるまで待つ
+func (q *chairLocationIngester) Close(ctx context.Context) error {
+	close(q.done)
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// キューに溜まっている位置を捨て、fn が終わるまで書き込みを止める。
+// 初期化でテーブルを作り直す間に、それより前に届いた位置が書き込まれないようにする
+func (q *chairLocationIngester) DiscardDuring(fn func() error) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	q.queue = make([]ChairLocation, 0, chairLocationBatchSize)
+	q.mu.Unlock()
+
+	return fn()
+}
+
+func (q *chairLocationIngester) flush() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	for {
+		q.mu.Lock()
+		n := min(len(q.queue), chairLocationBatchSize)
+		if n == 0 {
+			q.mu.Unlock()
+			return
+		}
+		batch := make([]ChairLocation, n)
+		copy(batch, q.queue)
+		q.queue = q.queue[n:]
+		if len(q.queue) == 0 {
+			q.queue = make([]ChairLocation, 0, chairLocationBatchSize)
+		}
+		q.mu.Unlock()
+
+		q.insert(batch)
+	}
+}
+
+func (q *chairLocationIngester) insert(batch []ChairLocation) {
+	for attempt := 1; ; attempt++ {
+		_, err := db.NamedExec(`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :created_at)`, batch)
+		if err == nil {
+			q.inserted.Add(int64(len(batch)))
+			q.lastFlushedAt.Store(time.Now().UnixMilli())
+			return
+		}
+
+		if attempt >= chairLocationMaxAttempts {
+			q.failedBatches.Add(1)
+			q.dropped.Add(int64(len(batch)))
+			log.Printf("failed to insert chair locations, dropped %d points: %v", len(batch), err)
+			return
+		}
+		q.retries.Add(1)
+		log.Printf("failed to insert chair locations, retrying: %v", err)
+		time.Sleep(chairLocationRetryBaseDelay << (attempt - 1))
+	}
+}
+
+func (q *chairLocationIngester) Metrics() chairLocationIngesterMetrics {
+	q.mu.Lock()
+	depth := len(q.queue)
+	reserved := q.reserved
+	q.mu.Unlock()
+
+	return chairLocationIngesterMetrics{
+		QueueDepth:    depth,
+		Reserved:      reserved,
+		QueueSize:     chairLocationQueueSize,
+		Enqueued:      q.enqueued.Load(),
+		Inserted:      q.inserted.Load(),
+		Rejected:      q.rejected.Load(),
+		Dropped:       q.dropped.Load(),
+		Retries:       q.retries.Load(),
+		FailedBatches: q.failedBatches.Load(),
+		LastFlushedAt: q.lastFlushedAt.Load(),
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChairLocationIngesterReserve(t *testing.T) {
+	q := newChairLocationIngester()
+	q.queue = make([]ChairLocation, chairLocationQueueSize-2)
+
+	if err := q.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Reserve(); !errors.Is(err, errChairLocationQueueFull) {
+		t.Fatalf("Reserve() = %v, want %v", err, errChairLocationQueueFull)
+	}
+
+	// 確保した空きを返せば、また受け付けられる
+	q.Release()
+	if err := q.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Enqueue(ChairLocation{ID: "a"})
+	q.Enqueue(ChairLocation{ID: "b"})
+	m := q.Metrics()
+	if m.QueueDepth != chairLocationQueueSize || m.Reserved != 0 {
+		t.Errorf("queue_depth = %d, reserved = %d, want %d, 0", m.QueueDepth, m.Reserved, chairLocationQueueSize)
+	}
+	if m.Enqueued != 2 || m.Rejected != 1 {
+		t.Errorf("enqueued = %d, rejected = %d, want 2, 1", m.Enqueued, m.Rejected)
+	}
+}
+
+func TestChairLocationIngesterDiscardDuring(t *testing.T) {
+	q := newChairLocationIngester()
+	for _, id := range []string{"a", "b"} {
+		if err := q.Reserve(); err != nil {
+			t.Fatal(err)
+		}
+		q.Enqueue(ChairLocation{ID: id})
+	}
+
+	called := false
+	if err := q.DiscardDuring(func() error {
+		called = true
+		// 止めている間は書き込まない
+		if q.flushMu.TryLock() {
+			t.Error("flush is not stopped")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("fn is not called")
+	}
+	if depth := q.Metrics().QueueDepth; depth != 0 {
+		t.Errorf("queue_depth = %d, want 0", depth)
+	}
+
+	want := errors.New("init failed")
+	if err := q.DiscardDuring(func() error { return want }); !errors.Is(err, want) {
+		t.Errorf("DiscardDuring() = %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 椅子の最新の位置と総移動距離。chair_locations から求めたものをメモリ上に持つ
+type chairLocationState struct {
+	Latitude      int
+	Longitude     int
+	TotalDistance int
+	UpdatedAt     time.Time
+}
+
+var (
+	latestChairLocationsMutex sync.RWMutex
+	latestChairLocations      = map[string]chairLocationState{}
+)
+
+// 位置を更新し、前回の位置からの移動距離を総移動距離に足す。移動距離も返す
+func updateChairLocation(chairID string, latitude, longitude int, at time.Time) (chairLocationState, int) {
+	latestChairLocationsMutex.Lock()
+	state, ok := latestChairLocations[chairID]
+	moved := 0
+	if ok {
+		moved = calculateDistance(state.Latitude, state.Longitude, latitude, longitude)
+		state.TotalDistance += moved
+	}
+	state.Latitude = latitude
+	state.Longitude = longitude
+	state.UpdatedAt = at
+	latestChairLocations[chairID] = state
+	latestChairLocationsMutex.Unlock()
+
+	chairIndex.UpdateLocation(chairID, latitude, longitude)
+	return state, moved
+}
+
+func getChairLocation(chairID string) (chairLocationState, bool) {
+	latestChairLocationsMutex.RLock()
+	defer latestChairLocationsMutex.RUnlock()
+
+	state, ok := latestChairLocations[chairID]
+	return state, ok
+}
+
+// chair_locations を椅子ごとに古い順にたどって、最新の位置と総移動距離を求める
+func InitChairLocationStore(db *sqlx.DB) error {
+	rows, err := db.Queryx("SELECT chair_id, latitude, longitude, created_at FROM chair_locations ORDER BY chair_id, created_at, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	store := map[string]chairLocationState{}
+	for rows.Next() {
+		var l struct {
+			ChairID   string    `db:"chair_id"`
+			Latitude  int       `db:"latitude"`
+			Longitude int       `db:"longitude"`
+			CreatedAt time.Time `db:"created_at"`
+		}
+		if err := rows.StructScan(&l); err != nil {
+			return err
+		}
+		state, ok := store[l.ChairID]
+		if ok {
+			state.TotalDistance += calculateDistance(state.Latitude, state.Longitude, l.Latitude, l.Longitude)
+		}
+		state.Latitude = l.Latitude
+		state.Longitude = l.Longitude
+		state.UpdatedAt = l.CreatedAt
+		store[l.ChairID] = state
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	latestChairLocationsMutex.Lock()
+	latestChairLocations = store
+	latestChairLocationsMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+const chairMaintenanceSyncInterval = 5 * time.Second
+
+// 椅子が speed の距離だけ進むのにかかる時間
+func getChairMoveInterval(ctx context.Context, tx executableGet) (time.Duration, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'chair_move_interval_ms'"); err != nil {
+		return 0, err
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// 椅子が配車位置に向かい、目的地に着くまでにかかる時間の見積もり
+func estimateRideDuration(speed, distance int, moveInterval time.Duration) time.Duration {
+	if speed <= 0 {
+		return 0
+	}
+	return time.Duration((distance+speed-1)/speed) * moveInterval
+}
+
+// until までに始まるメンテナンスがあるか。実施中のものも含む
+func chairHasMaintenanceBefore(ctx context.Context, tx executableGet, chairID string, until time.Time) (bool, error) {
+	var exists bool
+	if err := tx.GetContext(
+		ctx,
+		&exists,
+		"SELECT EXISTS (SELECT 1 FROM chair_maintenance_windows WHERE chair_id = ? AND canceled_at IS NULL AND starts_at < ? AND ends_at > ?)",
+		chairID, until, time.Now(),
+	); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func getChairIDsInMaintenance(ctx context.Context, at time.Time) ([]string, error) {
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, "SELECT DISTINCT chair_id FROM chair_maintenance_windows WHERE canceled_at IS NULL AND starts_at <= ? AND ends_at > ?", at, at); err != nil {
+		return nil, err
+	}
+	return chairIDs, nil
+}
+
+// メンテナンスが始まった椅子を配車の対象から外し、終わった椅子を戻す
+func syncChairMaintenance() {
+	ctx := context.Background()
+
+	chairIDs, err := getChairIDsInMaintenance(ctx, time.Now())
+	if err != nil {
+		log.Printf("failed to get chairs in maintenance: %v", err)
+		return
+	}
+	inMaintenance := make(map[string]bool, len(chairIDs))
+	for _, chairID := range chairIDs {
+		inMaintenance[chairID] = true
+		chairIndex.SetMaintenance(chairID, true)
+	}
+	for _, chairID := range chairIndex.MaintenanceChairIDs() {
+		if !inMaintenance[chairID] {
+			chairIndex.SetMaintenance(chairID, false)
+		}
+	}
+}
+
+// ライドの途中で受付停止を要求していた椅子を、椅子にライドが残っていなければ受付停止にする。
+// ライドが終わったときだけでなく、割り当てが外れたときにも呼ぶ
+func applyPendingChairDeactivation(ctx context.Context, chairID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reason string
+	if err := tx.GetContext(ctx, &reason, "SELECT reason FROM chair_pending_deactivations WHERE chair_id = ? FOR UPDATE", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	busy, err := chairHasActiveRide(ctx, tx, chairID)
+	if err != nil {
+		return err
+	}
+	if busy {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_pending_deactivations WHERE chair_id = ?", chairID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chairID); err != nil {
+		return err
+	}
+	endReason := chairShiftEndReasonDeactivated
+	if reason == chairPendingDeactivationForcedBreak {
+		endReason = chairShiftEndReasonForcedBreak
+	}
+	if err := endChairShift(ctx, tx, chairID, time.Now(), endReason); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	chairIndex.SetActive(chairID, false)
+	return nil
+}
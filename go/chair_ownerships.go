@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// オーナーが椅子を持っていた期間。売上や明細は、ライドが完了したときに椅子を持っていたオーナーに計上する
+type ownedChairPeriod struct {
+	Chair
+	OwnedFrom  time.Time  `db:"owned_from"`
+	OwnedUntil *time.Time `db:"owned_until"`
+}
+
+// [since, until] と重なる部分。重ならなければ false を返す。until は含む
+func (p *ownedChairPeriod) clip(since, until time.Time) (time.Time, time.Time, bool) {
+	if p.OwnedFrom.After(since) {
+		since = p.OwnedFrom
+	}
+	// 所有が終わった日時ちょうどのライドは次のオーナーに入る
+	if p.OwnedUntil != nil && !p.OwnedUntil.After(until) {
+		until = p.OwnedUntil.Add(-time.Millisecond)
+	}
+	return since, until, !since.After(until)
+}
+
+// 1時間単位の集計がこの期間に入るか。移管した時間帯の集計は移管先のオーナーに入る
+func (p *ownedChairPeriod) containsHourlyBucket(bucketStart time.Time) bool {
+	if bucketStart.Before(p.OwnedFrom.Truncate(time.Hour)) {
+		return false
+	}
+	return p.OwnedUntil == nil || bucketStart.Before(p.OwnedUntil.Truncate(time.Hour))
+}
+
+// オーナーが今持っている椅子と、以前持っていた椅子の所有期間を、所有を始めた順に返す
+func getOwnedChairPeriods(ctx context.Context, tx *sqlx.Tx, ownerID string) ([]ownedChairPeriod, error) {
+	periods := []ownedChairPeriod{}
+	if err := tx.SelectContext(
+		ctx,
+		&periods,
+		`SELECT chairs.*, chairs.created_at AS owned_from, CAST(NULL AS DATETIME(6)) AS owned_until
+		FROM chairs
+		WHERE chairs.owner_id = ? AND NOT EXISTS (SELECT 1 FROM chair_ownerships WHERE chair_ownerships.chair_id = chairs.id)
+		UNION ALL
+		SELECT chairs.*, chair_ownerships.started_at AS owned_from, chair_ownerships.ended_at AS owned_until
+		FROM chair_ownerships JOIN chairs ON chairs.id = chair_ownerships.chair_id
+		WHERE chair_ownerships.owner_id = ?
+		ORDER BY owned_from`,
+		ownerID, ownerID,
+	); err != nil {
+		return nil, err
+	}
+	return periods, nil
+}
+
+// 移管を所有期間として記録する。初めての移管では、登録時から移管元のオーナーが持っていた期間も記録する
+func recordChairTransfer(ctx context.Context, tx *sqlx.Tx, chair *Chair, toOwnerID string, at time.Time) error {
+	var recorded bool
+	if err := tx.GetContext(ctx, &recorded, "SELECT EXISTS (SELECT 1 FROM chair_ownerships WHERE chair_id = ?)", chair.ID); err != nil {
+		return err
+	}
+	if recorded {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair_ownerships SET ended_at = ? WHERE chair_id = ? AND ended_at IS NULL", at, chair.ID); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO chair_ownerships (chair_id, owner_id, started_at, ended_at) VALUES (?, ?, ?, ?)",
+			chair.ID, chair.OwnerID, chair.CreatedAt, at,
+		); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO chair_ownerships (chair_id, owner_id, started_at) VALUES (?, ?, ?)", chair.ID, toOwnerID, at)
+	return err
+}
+
+// 今のオーナーが椅子を持ち始めた日時
+func getChairOwnedSince(ctx context.Context, tx executableGet, chairID string, createdAt time.Time) (time.Time, error) {
+	var startedAt time.Time
+	if err := tx.GetContext(ctx, &startedAt, "SELECT started_at FROM chair_ownerships WHERE chair_id = ? AND ended_at IS NULL", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return createdAt, nil
+		}
+		return time.Time{}, err
+	}
+	return startedAt, nil
+}
+
+// rides.updated_at の時点で ? のオーナーが rides.chair_id の椅子を持っていたか。オーナーIDを2回渡すこと
+const rideOwnedBySQL = `(
+	EXISTS (SELECT 1 FROM chairs WHERE chairs.id = rides.chair_id AND chairs.owner_id = ? AND NOT EXISTS (SELECT 1 FROM chair_ownerships WHERE chair_ownerships.chair_id = chairs.id))
+	OR EXISTS (
+		SELECT 1 FROM chair_ownerships
+		WHERE chair_ownerships.chair_id = rides.chair_id AND chair_ownerships.owner_id = ?
+			AND rides.updated_at >= chair_ownerships.started_at AND (chair_ownerships.ended_at IS NULL OR rides.updated_at < chair_ownerships.ended_at)
+	)
+)`
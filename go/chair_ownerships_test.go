@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwnedChairPeriodClip(t *testing.T) {
+	from := time.Date(2024, 12, 2, 10, 30, 0, 0, time.UTC)
+	until := time.Date(2024, 12, 4, 15, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2024, 12, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name      string
+		period    ownedChairPeriod
+		since     time.Time
+		until     time.Time
+		wantSince time.Time
+		wantUntil time.Time
+		wantOK    bool
+	}{
+		{
+			name:      "current owner",
+			period:    ownedChairPeriod{OwnedFrom: from},
+			since:     day(1),
+			until:     day(10),
+			wantSince: from,
+			wantUntil: day(10),
+			wantOK:    true,
+		},
+		{
+			// 所有が終わった日時ちょうどは次のオーナーに入る
+			name:      "previous owner",
+			period:    ownedChairPeriod{OwnedFrom: from, OwnedUntil: &until},
+			since:     day(1),
+			until:     day(10),
+			wantSince: from,
+			wantUntil: until.Add(-time.Millisecond),
+			wantOK:    true,
+		},
+		{
+			name:      "inside the period",
+			period:    ownedChairPeriod{OwnedFrom: from, OwnedUntil: &until},
+			since:     day(3),
+			until:     day(4),
+			wantSince: day(3),
+			wantUntil: day(4),
+			wantOK:    true,
+		},
+		{
+			name:   "after the period",
+			period: ownedChairPeriod{OwnedFrom: from, OwnedUntil: &until},
+			since:  until,
+			until:  day(10),
+			wantOK: false,
+		},
+		{
+			name:   "before the period",
+			period: ownedChairPeriod{OwnedFrom: from},
+			since:  day(1),
+			until:  day(2),
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, until, ok := tt.period.clip(tt.since, tt.until)
+			if ok != tt.wantOK {
+				t.Fatalf("clip() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (!since.Equal(tt.wantSince) || !until.Equal(tt.wantUntil)) {
+				t.Errorf("clip() = [%s, %s], want [%s, %s]", since, until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestOwnedChairPeriodContainsHourlyBucket(t *testing.T) {
+	transferredAt := time.Date(2024, 12, 4, 15, 20, 0, 0, time.UTC)
+	previous := ownedChairPeriod{OwnedFrom: time.Date(2024, 12, 1, 9, 0, 0, 0, time.UTC), OwnedUntil: &transferredAt}
+	current := ownedChairPeriod{OwnedFrom: transferredAt}
+
+	// 移管した時間帯の集計は移管先だけに入る
+	for _, tt := range []struct {
+		bucket       time.Time
+		wantPrevious bool
+		wantCurrent  bool
+	}{
+		{bucket: time.Date(2024, 12, 4, 14, 0, 0, 0, time.UTC), wantPrevious: true, wantCurrent: false},
+		{bucket: time.Date(2024, 12, 4, 15, 0, 0, 0, time.UTC), wantPrevious: false, wantCurrent: true},
+		{bucket: time.Date(2024, 12, 4, 16, 0, 0, 0, time.UTC), wantPrevious: false, wantCurrent: true},
+		{bucket: time.Date(2024, 12, 1, 8, 0, 0, 0, time.UTC), wantPrevious: false, wantCurrent: false},
+	} {
+		if got := previous.containsHourlyBucket(tt.bucket); got != tt.wantPrevious {
+			t.Errorf("previous.containsHourlyBucket(%s) = %v, want %v", tt.bucket, got, tt.wantPrevious)
+		}
+		if got := current.containsHourlyBucket(tt.bucket); got != tt.wantCurrent {
+			t.Errorf("current.containsHourlyBucket(%s) = %v, want %v", tt.bucket, got, tt.wantCurrent)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	chairShiftEndReasonDeactivated = "deactivated"
+	chairShiftEndReasonForcedBreak = "forced_break"
+	chairShiftEndReasonRetired     = "retired"
+
+	chairPendingDeactivationRequested   = "requested"
+	chairPendingDeactivationForcedBreak = "forced_break"
+
+	chairShiftLimitSweepInterval = 30 * time.Second
+	maxShiftLimitMinutes         = 24 * 60
+)
+
+// 受付中のシフトが無いときだけ新しいシフトを始める
+func startChairShift(ctx context.Context, tx *sqlx.Tx, chairID string, at time.Time) error {
+	var open bool
+	if err := tx.GetContext(ctx, &open, "SELECT EXISTS (SELECT 1 FROM chair_shifts WHERE chair_id = ? AND ended_at IS NULL)", chairID); err != nil {
+		return err
+	}
+	if open {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO chair_shifts (id, chair_id, started_at) VALUES (?, ?, ?)", ulid.Make().String(), chairID, at)
+	return err
+}
+
+// 初期データの椅子はシフトを持たずに受付しているので、受付中の椅子にシフトを始めさせる。
+// そうしないと勤務時間の上限の対象にならない
+func startShiftsOfActiveChairs(ctx context.Context) error {
+	chairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&chairIDs,
+		"SELECT id FROM chairs WHERE is_active = TRUE AND NOT EXISTS (SELECT 1 FROM chair_shifts WHERE chair_shifts.chair_id = chairs.id AND chair_shifts.ended_at IS NULL)",
+	); err != nil {
+		return err
+	}
+	if len(chairIDs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	shifts := make([]ChairShift, 0, len(chairIDs))
+	for _, chairID := range chairIDs {
+		shifts = append(shifts, ChairShift{ID: ulid.Make().String(), ChairID: chairID, StartedAt: now})
+	}
+	_, err := db.NamedExecContext(ctx, "INSERT INTO chair_shifts (id, chair_id, started_at) VALUES (:id, :chair_id, :started_at)", shifts)
+	return err
+}
+
+func endChairShift(ctx context.Context, tx *sqlx.Tx, chairID string, at time.Time, reason string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE chair_shifts SET ended_at = ?, end_reason = ? WHERE chair_id = ? AND ended_at IS NULL", at, reason, chairID)
+	return err
+}
+
+// 設定が無いオーナーの椅子には上限を設けない
+func getOwnerShiftLimit(ctx context.Context, tx executableGet, ownerID string) (*OwnerShiftLimit, error) {
+	limit := &OwnerShiftLimit{}
+	if err := tx.GetContext(ctx, limit, "SELECT * FROM owner_shift_limits WHERE owner_id = ?", ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &OwnerShiftLimit{OwnerID: ownerID}, nil
+		}
+		return nil, err
+	}
+	return limit, nil
+}
+
+// at の時点で続けて受付している期間の始まり。min_break_minutes に満たない休憩は受付を続けているものとみなすので、
+// 直前のシフトの終わりからその時間が経っていなければ、直前のシフトから続いていることになる。続いていなければ nil
+func getContinuousDutyStart(ctx context.Context, tx *sqlx.Tx, chairID string, limit *OwnerShiftLimit, at time.Time) (*time.Time, error) {
+	maxContinuous := time.Duration(limit.MaxContinuousMinutes) * time.Minute
+	minBreak := time.Duration(limit.MinBreakMinutes) * time.Minute
+
+	// これより前に終わったシフトから続いているなら、上限を超えているかどうかはそれより後のシフトだけで決まる
+	shifts := []ChairShift{}
+	if err := tx.SelectContext(
+		ctx,
+		&shifts,
+		"SELECT * FROM chair_shifts WHERE chair_id = ? AND (ended_at IS NULL OR ended_at >= ?) ORDER BY started_at DESC",
+		chairID, at.Add(-maxContinuous-minBreak),
+	); err != nil {
+		return nil, err
+	}
+	return continuousDutyStart(shifts, minBreak, at), nil
+}
+
+// shifts は開始日時の新しい順に並んでいること
+func continuousDutyStart(shifts []ChairShift, minBreak time.Duration, at time.Time) *time.Time {
+	var start *time.Time
+	for _, shift := range shifts {
+		if shift.EndedAt != nil {
+			from := at
+			if start != nil {
+				from = *start
+			}
+			if from.Sub(*shift.EndedAt) >= minBreak {
+				break
+			}
+		}
+		startedAt := shift.StartedAt
+		start = &startedAt
+	}
+	return start
+}
+
+// 続けて受付している時間が上限に達しているか。上限が無ければ常に false
+func chairShiftLimitReached(ctx context.Context, tx *sqlx.Tx, chairID string, limit *OwnerShiftLimit, at time.Time) (bool, error) {
+	if limit.MaxContinuousMinutes <= 0 {
+		return false, nil
+	}
+	start, err := getContinuousDutyStart(ctx, tx, chairID, limit, at)
+	if err != nil {
+		return false, err
+	}
+	return start != nil && at.Sub(*start) >= time.Duration(limit.MaxContinuousMinutes)*time.Minute, nil
+}
+
+// 続けて受付している時間が上限に達した椅子を受付停止にする。ライドの途中なら、ライドが終わってから停止する
+func enforceShiftLimits() {
+	ctx := context.Background()
+
+	chairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&chairIDs,
+		`SELECT chair_shifts.chair_id FROM chair_shifts
+			JOIN chairs ON chairs.id = chair_shifts.chair_id
+			JOIN owner_shift_limits ON owner_shift_limits.owner_id = chairs.owner_id
+		WHERE chair_shifts.ended_at IS NULL AND owner_shift_limits.max_continuous_minutes > 0`,
+	); err != nil {
+		log.Printf("failed to get chairs on shift: %v", err)
+		return
+	}
+
+	for _, chairID := range chairIDs {
+		if err := enforceChairShiftLimit(ctx, chairID); err != nil {
+			log.Printf("failed to enforce shift limit of chair %s: %v", chairID, err)
+		}
+	}
+}
+
+func enforceChairShiftLimit(ctx context.Context, chairID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	limit, err := getOwnerShiftLimit(ctx, tx, chair.OwnerID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	reached, err := chairShiftLimitReached(ctx, tx, chair.ID, limit, now)
+	if err != nil {
+		return err
+	}
+	if !reached {
+		return nil
+	}
+
+	busy, err := chairHasActiveRide(ctx, tx, chair.ID)
+	if err != nil {
+		return err
+	}
+	if busy {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO chair_pending_deactivations (chair_id, reason) VALUES (?, ?) ON DUPLICATE KEY UPDATE reason = VALUES(reason)",
+			chair.ID, chairPendingDeactivationForcedBreak,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chair.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_pending_deactivations WHERE chair_id = ?", chair.ID); err != nil {
+		return err
+	}
+	if err := endChairShift(ctx, tx, chair.ID, now, chairShiftEndReasonForcedBreak); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	chairIndex.SetActive(chair.ID, false)
+	return nil
+}
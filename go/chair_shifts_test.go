@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContinuousDutyStart(t *testing.T) {
+	at := time.Date(2024, 12, 5, 12, 0, 0, 0, time.UTC)
+	clock := func(hour, min int) time.Time { return time.Date(2024, 12, 5, hour, min, 0, 0, time.UTC) }
+	clockPtr := func(hour, min int) *time.Time {
+		t := clock(hour, min)
+		return &t
+	}
+	minBreak := 30 * time.Minute
+
+	tests := []struct {
+		name   string
+		shifts []ChairShift
+		want   *time.Time
+	}{
+		{name: "no shifts", want: nil},
+		{
+			name:   "open shift",
+			shifts: []ChairShift{{StartedAt: clock(11, 0)}},
+			want:   clockPtr(11, 0),
+		},
+		{
+			name:   "enough break since the last shift",
+			shifts: []ChairShift{{StartedAt: clock(10, 0), EndedAt: clockPtr(11, 0)}},
+			want:   nil,
+		},
+		{
+			// 受付を再開しようとしている時点で休憩が足りなければ、直前のシフトから続いている
+			name:   "short break since the last shift",
+			shifts: []ChairShift{{StartedAt: clock(10, 0), EndedAt: clockPtr(11, 50)}},
+			want:   clockPtr(10, 0),
+		},
+		{
+			name: "short break between shifts",
+			shifts: []ChairShift{
+				{StartedAt: clock(11, 0)},
+				{StartedAt: clock(9, 0), EndedAt: clockPtr(10, 45)},
+			},
+			want: clockPtr(9, 0),
+		},
+		{
+			// 休憩が足りないかどうかは、その後のシフトの開始日時から数える
+			name: "short breaks chain",
+			shifts: []ChairShift{
+				{StartedAt: clock(11, 0)},
+				{StartedAt: clock(9, 0), EndedAt: clockPtr(10, 45)},
+				{StartedAt: clock(7, 0), EndedAt: clockPtr(8, 50)},
+			},
+			want: clockPtr(7, 0),
+		},
+		{
+			name: "break of exactly min_break_minutes",
+			shifts: []ChairShift{
+				{StartedAt: clock(11, 0)},
+				{StartedAt: clock(9, 0), EndedAt: clockPtr(10, 30)},
+			},
+			want: clockPtr(11, 0),
+		},
+		{
+			name: "enough break stops the chain",
+			shifts: []ChairShift{
+				{StartedAt: clock(11, 0)},
+				{StartedAt: clock(9, 0), EndedAt: clockPtr(10, 45)},
+				{StartedAt: clock(6, 0), EndedAt: clockPtr(8, 0)},
+			},
+			want: clockPtr(9, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := continuousDutyStart(tt.shifts, minBreak, at)
+			if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(*tt.want)) {
+				t.Errorf("continuousDutyStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
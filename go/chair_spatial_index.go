@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// グリッドの1マスの大きさ。近くの椅子の検索で使う距離 (既定 50) に対して十分小さくしておく
+const chairGridCellSize = 10
+
+type chairGridCell struct {
+	X int
+	Y int
+}
+
+func chairGridCellOf(latitude, longitude int) chairGridCell {
+	return chairGridCell{X: floorDiv(latitude, chairGridCellSize), Y: floorDiv(longitude, chairGridCellSize)}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+type chairIndexEntry struct {
+	ChairID   string
+	Latitude  int
+	Longitude int
+	Distance  int
+
+	located     bool
+	active      bool
+	busy        bool
+	online      bool
+	lastSeenAt  time.Time
+	maintenance bool
+}
+
+func (e *chairIndexEntry) available() bool {
+	return e.located && e.active && !e.busy && e.online && !e.maintenance
+}
+
+// 配車を受けられる椅子 (受付中で、進行中のライドが無く、位置が分かっていて、オンラインで、メンテナンス中でないもの) をグリッドで引けるようにする索引。
+// 検索の手間は椅子の総数ではなく、検索範囲に入るマスの数とその中の椅子の数で決まる
+type chairSpatialIndex struct {
+	mu     sync.RWMutex
+	chairs map[string]*chairIndexEntry
+	cells  map[chairGridCell]map[string]*chairIndexEntry
+}
+
+var chairIndex = newChairSpatialIndex()
+
+func newChairSpatialIndex() *chairSpatialIndex {
+	return &chairSpatialIndex{
+		chairs: map[string]*chairIndexEntry{},
+		cells:  map[chairGridCell]map[string]*chairIndexEntry{},
+	}
+}
+
+// 呼び出し元で mu をロックしておくこと
+func (ix *chairSpatialIndex) entry(chairID string) *chairIndexEntry {
+	e, ok := ix.chairs[chairID]
+	if !ok {
+		e = &chairIndexEntry{ChairID: chairID}
+		ix.chairs[chairID] = e
+	}
+	return e
+}
+
+// 呼び出し元で mu をロックしておくこと
+func (ix *chairSpatialIndex) remove(e *chairIndexEntry) {
+	cell := chairGridCellOf(e.Latitude, e.Longitude)
+	if chairs, ok := ix.cells[cell]; ok {
+		delete(chairs, e.ChairID)
+		if len(chairs) == 0 {
+			delete(ix.cells, cell)
+		}
+	}
+}
+
+// 呼び出し元で mu をロックしておくこと
+func (ix *chairSpatialIndex) add(e *chairIndexEntry) {
+	cell := chairGridCellOf(e.Latitude, e.Longitude)
+	chairs, ok := ix.cells[cell]
+	if !ok {
+		chairs = map[string]*chairIndexEntry{}
+		ix.cells[cell] = chairs
+	}
+	chairs[e.ChairID] = e
+}
+
+// 状態を変える。配車を受けられるかどうかが変わればマスへの出し入れも行う
+func (ix *chairSpatialIndex) update(chairID string, f func(e *chairIndexEntry)) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	e := ix.entry(chairID)
+	if e.available() {
+		ix.remove(e)
+	}
+	f(e)
+	if e.available() {
+		ix.add(e)
+	}
+}
+
+func (ix *chairSpatialIndex) UpdateLocation(chairID string, latitude, longitude int) {
+	ix.update(chairID, func(e *chairIndexEntry) {
+		e.Latitude = latitude
+		e.Longitude = longitude
+		e.located = true
+	})
+}
+
+func (ix *chairSpatialIndex) SetActive(chairID string, active bool) {
+	ix.update(chairID, func(e *chairIndexEntry) {
+		e.active = active
+	})
+}
+
+func (ix *chairSpatialIndex) SetBusy(chairID string, busy bool) {
+	ix.update(chairID, func(e *chairIndexEntry) {
+		e.busy = busy
+	})
+}
+
+// 椅子から何かしらのリクエストがあったことを記録し、オフラインだったらオンラインに戻す
+func (ix *chairSpatialIndex) Touch(chairID string, at time.Time) {
+	ix.update(chairID, func(e *chairIndexEntry) {
+		e.online = true
+		e.lastSeenAt = at
+	})
+}
+
+// before より後に一度もリクエストの無いオンラインの椅子をオフラインにし、その ID を返す
+func (ix *chairSpatialIndex) MarkOffline(before time.Time) []string {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	offline := []string{}
+	for _, e := range ix.chairs {
+		if !e.online || !e.lastSeenAt.Before(before) {
+			continue
+		}
+		if e.available() {
+			ix.remove(e)
+		}
+		e.online = false
+		offline = append(offline, e.ChairID)
+	}
+	return offline
+}
+
+func (ix *chairSpatialIndex) SetMaintenance(chairID string, maintenance bool) {
+	ix.update(chairID, func(e *chairIndexEntry) {
+		e.maintenance = maintenance
+	})
+}
+
+// メンテナンス中としている椅子の ID
+func (ix *chairSpatialIndex) MaintenanceChairIDs() []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	chairIDs := []string{}
+	for _, e := range ix.chairs {
+		if e.maintenance {
+			chairIDs = append(chairIDs, e.ChairID)
+		}
+	}
+	return chairIDs
+}
+
+func (ix *chairSpatialIndex) IsOnline(chairID string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	e, ok := ix.chairs[chairID]
+	return ok && e.online
+}
+
+func (ix *chairSpatialIndex) IsAvailable(chairID string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	e, ok := ix.chairs[chairID]
+	return ok && e.available()
+}
+
+// (latitude, longitude) からのマンハッタン距離が distance 以下の配車可能な椅子を、近い順に返す
+func (ix *chairSpatialIndex) Search(latitude, longitude, distance int) []chairIndexEntry {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	result := []chairIndexEntry{}
+	if distance < 0 {
+		return result
+	}
+	minCell := chairGridCellOf(latitude-distance, longitude-distance)
+	maxCell := chairGridCellOf(latitude+distance, longitude+distance)
+
+	visit := func(chairs map[string]*chairIndexEntry) {
+		for _, e := range chairs {
+			d := calculateDistance(latitude, longitude, e.Latitude, e.Longitude)
+			if d <= distance {
+				found := *e
+				found.Distance = d
+				result = append(result, found)
+			}
+		}
+	}
+	// 範囲が広く、範囲内のマスを総なめするより椅子のいるマスを見る方が早い場合はそちらを使う
+	if (maxCell.X-minCell.X+1)*(maxCell.Y-minCell.Y+1) > len(ix.cells) {
+		for cell, chairs := range ix.cells {
+			if cell.X >= minCell.X && cell.X <= maxCell.X && cell.Y >= minCell.Y && cell.Y <= maxCell.Y {
+				visit(chairs)
+			}
+		}
+	} else {
+		for x := minCell.X; x <= maxCell.X; x++ {
+			for y := minCell.Y; y <= maxCell.Y; y++ {
+				if chairs, ok := ix.cells[chairGridCell{X: x, Y: y}]; ok {
+					visit(chairs)
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Distance != result[j].Distance {
+			return result[i].Distance < result[j].Distance
+		}
+		return result[i].ChairID < result[j].ChairID
+	})
+	return result
+}
+
+// 配車可能な椅子のうち、(latitude, longitude) から最も遠いものまでの距離。椅子が無ければ -1
+func (ix *chairSpatialIndex) MaxDistance(latitude, longitude int) int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	maxDistance := -1
+	for cell := range ix.cells {
+		// マスの四隅のうち最も遠いものまでの距離で見積もる
+		dx := max(abs(latitude-cell.X*chairGridCellSize), abs(latitude-(cell.X+1)*chairGridCellSize))
+		dy := max(abs(longitude-cell.Y*chairGridCellSize), abs(longitude-(cell.Y+1)*chairGridCellSize))
+		maxDistance = max(maxDistance, dx+dy)
+	}
+	return maxDistance
+}
+
+// 受付中かどうかと進行中のライド、メンテナンスを DB から読み、位置はメモリ上の最新のものを使って索引を作り直す
+func InitChairSpatialIndex(db *sqlx.DB) error {
+	activeChairIDs := []string{}
+	if err := db.Select(&activeChairIDs, "SELECT id FROM chairs WHERE is_active = TRUE"); err != nil {
+		return err
+	}
+	busyChairIDs := []string{}
+	if err := db.Select(&busyChairIDs, "SELECT DISTINCT rides.chair_id FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id WHERE rides.chair_id IS NOT NULL AND latest_ride_statuses.status <> 'COMPLETED'"); err != nil {
+		return err
+	}
+
+	maintenanceChairIDs, err := getChairIDsInMaintenance(context.Background(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	ix := newChairSpatialIndex()
+	for _, id := range activeChairIDs {
+		ix.entry(id).active = true
+	}
+	for _, id := range busyChairIDs {
+		ix.entry(id).busy = true
+	}
+	for _, id := range maintenanceChairIDs {
+		ix.entry(id).maintenance = true
+	}
+	latestChairLocationsMutex.RLock()
+	for id, location := range latestChairLocations {
+		e := ix.entry(id)
+		e.Latitude = location.Latitude
+		e.Longitude = location.Longitude
+		e.located = true
+	}
+	latestChairLocationsMutex.RUnlock()
+	// 起動直後はどの椅子もまだリクエストしてきていないので、オフラインと判定されるまでの猶予を与える
+	now := time.Now()
+	for _, e := range ix.chairs {
+		e.online = true
+		e.lastSeenAt = now
+	}
+	for _, e := range ix.chairs {
+		if e.available() {
+			ix.add(e)
+		}
+	}
+
+	chairIndex.mu.Lock()
+	chairIndex.chairs = ix.chairs
+	chairIndex.cells = ix.cells
+	chairIndex.mu.Unlock()
+	return nil
+}
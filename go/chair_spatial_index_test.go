@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestChairSpatialIndex(chairs map[string]Coordinate) *chairSpatialIndex {
+	ix := newChairSpatialIndex()
+	now := time.Now()
+	for id, c := range chairs {
+		ix.SetActive(id, true)
+		ix.Touch(id, now)
+		ix.UpdateLocation(id, c.Latitude, c.Longitude)
+	}
+	return ix
+}
+
+func chairIDsOf(entries []chairIndexEntry) []string {
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.ChairID)
+	}
+	return ids
+}
+
+func TestFloorDiv(t *testing.T) {
+	for _, tt := range []struct{ a, b, want int }{
+		{a: 0, b: 10, want: 0},
+		{a: 9, b: 10, want: 0},
+		{a: 10, b: 10, want: 1},
+		{a: -1, b: 10, want: -1},
+		{a: -10, b: 10, want: -1},
+		{a: -11, b: 10, want: -2},
+	} {
+		if got := floorDiv(tt.a, tt.b); got != tt.want {
+			t.Errorf("floorDiv(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestChairSpatialIndexSearch(t *testing.T) {
+	ix := newTestChairSpatialIndex(map[string]Coordinate{
+		"a": {Latitude: 0, Longitude: 0},
+		"b": {Latitude: 3, Longitude: -4},
+		"c": {Latitude: -9, Longitude: -1},
+		"d": {Latitude: 25, Longitude: 25},
+		"e": {Latitude: -7, Longitude: 0},
+	})
+
+	tests := []struct {
+		name     string
+		distance int
+		want     []string
+	}{
+		{name: "same point", distance: 0, want: []string{"a"}},
+		// 距離が同じなら ID の順
+		{name: "ties are ordered by id", distance: 7, want: []string{"a", "b", "e"}},
+		{name: "across cell boundaries", distance: 10, want: []string{"a", "b", "e", "c"}},
+		// マスの数が椅子のいるマスの数より多いときは、椅子のいるマスだけを見る
+		{name: "wide range", distance: 1000, want: []string{"a", "b", "e", "c", "d"}},
+		{name: "negative distance", distance: -1, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ix.Search(0, 0, tt.distance)
+			ids := chairIDsOf(got)
+			if len(ids) != len(tt.want) {
+				t.Fatalf("Search() = %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("Search() = %v, want %v", ids, tt.want)
+				}
+			}
+			for _, e := range got {
+				if want := calculateDistance(0, 0, e.Latitude, e.Longitude); e.Distance != want {
+					t.Errorf("distance of %s = %d, want %d", e.ChairID, e.Distance, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChairSpatialIndexSearchSkipsUnavailableChairs(t *testing.T) {
+	ix := newTestChairSpatialIndex(map[string]Coordinate{
+		"active":      {Latitude: 1, Longitude: 1},
+		"busy":        {Latitude: 1, Longitude: 1},
+		"inactive":    {Latitude: 1, Longitude: 1},
+		"maintenance": {Latitude: 1, Longitude: 1},
+		"offline":     {Latitude: 1, Longitude: 1},
+	})
+	ix.SetBusy("busy", true)
+	ix.SetActive("inactive", false)
+	ix.SetMaintenance("maintenance", true)
+	ix.Touch("offline", time.Now().Add(-time.Minute))
+	ix.MarkOffline(time.Now().Add(-time.Second))
+	// 位置が分からない椅子は配車できない
+	ix.SetActive("unlocated", true)
+	ix.Touch("unlocated", time.Now())
+
+	if ids := chairIDsOf(ix.Search(0, 0, 10)); len(ids) != 1 || ids[0] != "active" {
+		t.Errorf("Search() = %v, want [active]", ids)
+	}
+
+	// ライドが終われば、また検索に出てくる
+	ix.SetBusy("busy", false)
+	if ids := chairIDsOf(ix.Search(0, 0, 10)); len(ids) != 2 {
+		t.Errorf("Search() = %v, want [active busy]", ids)
+	}
+}
+
+func TestChairSpatialIndexUpdateLocationMovesChair(t *testing.T) {
+	ix := newTestChairSpatialIndex(map[string]Coordinate{
+		"a": {Latitude: 0, Longitude: 0},
+	})
+	ix.UpdateLocation("a", 100, 100)
+
+	if ids := chairIDsOf(ix.Search(0, 0, 10)); len(ids) != 0 {
+		t.Errorf("Search() at the old location = %v, want []", ids)
+	}
+	if ids := chairIDsOf(ix.Search(100, 100, 0)); len(ids) != 1 {
+		t.Errorf("Search() at the new location = %v, want [a]", ids)
+	}
+}
+
+func TestChairSpatialIndexMaxDistance(t *testing.T) {
+	if got := newChairSpatialIndex().MaxDistance(0, 0); got != -1 {
+		t.Errorf("MaxDistance() of an empty index = %d, want -1", got)
+	}
+
+	chairs := map[string]Coordinate{
+		"a": {Latitude: 0, Longitude: 0},
+		"b": {Latitude: -35, Longitude: 12},
+		"c": {Latitude: 48, Longitude: -3},
+	}
+	ix := newTestChairSpatialIndex(chairs)
+	for _, origin := range []Coordinate{{Latitude: 0, Longitude: 0}, {Latitude: 100, Longitude: -100}, {Latitude: -7, Longitude: 5}} {
+		got := ix.MaxDistance(origin.Latitude, origin.Longitude)
+		// マス単位の見積もりなので、実際の最大の距離以上で、1マス分より大きくは外れない
+		want := 0
+		for _, c := range chairs {
+			want = max(want, calculateDistance(origin.Latitude, origin.Longitude, c.Latitude, c.Longitude))
+		}
+		if got < want || got > want+2*chairGridCellSize {
+			t.Errorf("MaxDistance(%d, %d) = %d, want between %d and %d", origin.Latitude, origin.Longitude, got, want, want+2*chairGridCellSize)
+		}
+		// 見積もった距離で検索すれば全ての椅子が見つかる
+		if n := len(ix.Search(origin.Latitude, origin.Longitude, got)); n != len(chairs) {
+			t.Errorf("Search(%d, %d, %d) found %d chairs, want %d", origin.Latitude, origin.Longitude, got, n, len(chairs))
+		}
+	}
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
 )
 
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// 最も待たせているリクエスト（ride）
+	// 最も待たせているリクエスト（ride）。割り当てた椅子が応答しなかったライドは既に待たせているので先に扱う
 	ride := &Ride{}
-	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at LIMIT 1`); err != nil {
+	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY EXISTS (SELECT 1 FROM ride_assignments WHERE ride_id = rides.id AND result = 'timeout') DESC, created_at LIMIT 1`); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -25,71 +31,624 @@ func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	type CandidateChair struct {
 		ID            string `db:"id"`
 		Speed         int    `db:"speed"`
-		Latitude      int    `db:"latitude"`
-		Longitude     int    `db:"longitude"`
+		Latitude      int
+		Longitude     int
 		EstimatedTime float32
 	}
-	candidates := make([]CandidateChair, 0)
-
-	q := `
-SELECT
-	chairs.id as id,
-	chair_models.speed as speed,
-	latest_chair_locations.latitude as latitude,
-	latest_chair_locations.longitude as longitude
-FROM
-    chairs
-	INNER JOIN chair_models
-        ON chairs.model = chair_models.name
-	INNER JOIN latest_chair_locations
-		ON chairs.id = latest_chair_locations.chair_id
-WHERE
-    chairs.is_active = TRUE;
-`
-
-	if err := db.SelectContext(ctx, &candidates, q); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+
+	var maxSpeed int
+	if err := db.GetContext(ctx, &maxSpeed, "SELECT MAX(speed) FROM chair_models"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	maxDistance := chairIndex.MaxDistance(ride.PickupLatitude, ride.PickupLongitude)
+	if maxDistance < 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// 配車位置の周りから探す範囲を広げていく。範囲の外の椅子は radius / maxSpeed より早くは着かないので、
+	// それより早く着く候補は範囲の外を見なくても最善と分かる
+	moveInterval, err := getChairMoveInterval(ctx, db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tripDistance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+
+	// 一度断った椅子や応答しなかった椅子には割り当てない
+	excluded, err := getExcludedChairIDs(ctx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var matched *CandidateChair
+	tried := map[string]bool{}
+	for _, chairID := range excluded {
+		tried[chairID] = true
+	}
+	for radius := chairGridCellSize; matched == nil; radius *= 2 {
+		covered := radius >= maxDistance
+
+		found := chairIndex.Search(ride.PickupLatitude, ride.PickupLongitude, radius)
+		locations := map[string]chairIndexEntry{}
+		chairIDs := []string{}
+		for _, e := range found {
+			if !tried[e.ChairID] {
+				locations[e.ChairID] = e
+				chairIDs = append(chairIDs, e.ChairID)
+			}
+		}
+
+		candidates := make([]CandidateChair, 0, len(chairIDs))
+		if len(chairIDs) > 0 {
+			query, args, err := sqlx.In("SELECT chairs.id, chair_models.speed FROM chairs INNER JOIN chair_models ON chairs.model = chair_models.name WHERE chairs.id IN (?)", chairIDs)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := db.SelectContext(ctx, &candidates, db.Rebind(query), args...); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		// 配車位置までの移動時間を算出
+		for i, chair := range candidates {
+			candidates[i].Latitude = locations[chair.ID].Latitude
+			candidates[i].Longitude = locations[chair.ID].Longitude
+			candidates[i].EstimatedTime = float32(locations[chair.ID].Distance) / float32(chair.Speed)
+		}
+
+		// 移動時間が短い順に、前のライドを終えている椅子を探す
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].EstimatedTime < candidates[j].EstimatedTime
+		})
+		bound := float32(radius) / float32(maxSpeed)
+		for i, candidate := range candidates {
+			if !covered && candidate.EstimatedTime > bound {
+				break
+			}
+			tried[candidate.ID] = true
+
+			// 営業エリアの決められた椅子は、配車位置と目的地の両方がエリア内のライドだけを受ける
+			if !chairCanServe(candidate.ID, Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude}) ||
+				!chairCanServe(candidate.ID, Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude}) {
+				continue
+			}
+
+			// ライドを終える前にメンテナンスが始まる椅子には割り当てない
+			distance := calculateDistance(candidate.Latitude, candidate.Longitude, ride.PickupLatitude, ride.PickupLongitude) + tripDistance
+			inMaintenance, err := chairHasMaintenanceBefore(ctx, db, candidate.ID, time.Now().Add(estimateRideDuration(candidate.Speed, distance, moveInterval)))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if inMaintenance {
+				continue
+			}
+
+			empty := false
+			if err := db.GetContext(ctx, &empty, "SELECT NOT EXISTS (  SELECT 1  FROM rides r  JOIN ride_statuses rs ON rs.ride_id = r.id  WHERE r.chair_id = ?  GROUP BY rs.ride_id  HAVING COUNT(rs.chair_sent_at) <> 6) AS all_completed;", candidate.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if empty {
+				matched = &candidates[i]
+				break
+			}
+		}
+
+		if matched == nil && covered {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
+	}
+
+	ackTimeout, err := getChairAckTimeout(ctx, db)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if len(candidates) == 0 {
-		w.WriteHeader(http.StatusNoContent)
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx.Rollback()
+	if err := assignRide(ctx, tx, ride.ID, matched.ID, time.Now().Add(ackTimeout)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairIndex.SetBusy(matched.ID, true)
 
-	// distanceFromPickupToDestination := abs(ride.PickupLatitude-ride.DestinationLatitude) + abs(ride.PickupLongitude-ride.DestinationLongitude)
-	// 配車位置までの移動時間を算出
-	for i, chair := range candidates {
-		distanceToPickup := abs(chair.Latitude-ride.PickupLatitude) + abs(chair.Longitude-ride.PickupLongitude)
-		candidates[i].EstimatedTime = float32(distanceToPickup) / float32(chair.Speed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalCampaign struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	CodePattern    string `json:"code_pattern"`
+	GrantOn        string `json:"grant_on"`
+	DiscountType   string `json:"discount_type"`
+	DiscountValue  int    `json:"discount_value"`
+	DiscountCap    *int   `json:"discount_cap,omitempty"`
+	StartsAt       *int64 `json:"starts_at,omitempty"`
+	EndsAt         *int64 `json:"ends_at,omitempty"`
+	MaxRedemptions *int   `json:"max_redemptions,omitempty"`
+	PerUserLimit   *int   `json:"per_user_limit,omitempty"`
+	Priority       int    `json:"priority"`
+	FundedBy       string `json:"funded_by"`
+}
+
+type internalGetCampaignsResponse struct {
+	Campaigns []internalCampaign `json:"campaigns"`
+}
+
+func internalGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	campaigns := []Campaign{}
+	if err := db.SelectContext(ctx, &campaigns, "SELECT * FROM campaigns ORDER BY priority DESC, created_at ASC"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	// 移動時間が最も短いものを 1 件取得
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].EstimatedTime < candidates[j].EstimatedTime
-	})
+	res := internalGetCampaignsResponse{Campaigns: []internalCampaign{}}
+	for _, c := range campaigns {
+		item := internalCampaign{
+			ID:             c.ID,
+			Name:           c.Name,
+			CodePattern:    c.CodePattern,
+			GrantOn:        c.GrantOn,
+			DiscountType:   c.DiscountType,
+			DiscountValue:  c.DiscountValue,
+			DiscountCap:    c.DiscountCap,
+			MaxRedemptions: c.MaxRedemptions,
+			PerUserLimit:   c.PerUserLimit,
+			Priority:       c.Priority,
+			FundedBy:       c.FundedBy,
+		}
+		if c.StartsAt != nil {
+			t := c.StartsAt.UnixMilli()
+			item.StartsAt = &t
+		}
+		if c.EndsAt != nil {
+			t := c.EndsAt.UnixMilli()
+			item.EndsAt = &t
+		}
+		res.Campaigns = append(res.Campaigns, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
 
-	var matched CandidateChair
-	empty := false
-	for _, candidate := range candidates {
-		if err := db.GetContext(ctx, &empty, "SELECT NOT EXISTS (  SELECT 1  FROM rides r  JOIN ride_statuses rs ON rs.ride_id = r.id  WHERE r.chair_id = ?  GROUP BY rs.ride_id  HAVING COUNT(rs.chair_sent_at) <> 6) AS all_completed;", candidate.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+type internalPostCampaignsResponse struct {
+	ID string `json:"id"`
+}
+
+// 管理者がキャンペーンを登録するためのAPI
+func internalPostCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalCampaign{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || req.CodePattern == "" || req.GrantOn == "" || req.DiscountType == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(name, code_pattern, grant_on, discount_type) are empty"))
+		return
+	}
+	switch req.GrantOn {
+	case campaignGrantOnSignup, campaignGrantOnInvitation, campaignGrantOnInvitationReward, campaignGrantOnPromo:
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid grant_on"))
+		return
+	}
+	switch req.DiscountType {
+	case discountTypeFixed:
+		if req.DiscountValue <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("discount_value must be positive"))
 			return
 		}
-		if empty {
-			matched = candidate
-			break
+	case discountTypePercent:
+		if req.DiscountValue <= 0 || req.DiscountValue > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("discount_value must be between 1 and 100"))
+			return
 		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid discount_type"))
+		return
 	}
-	if !empty {
-		w.WriteHeader(http.StatusNoContent)
+	switch req.FundedBy {
+	case "":
+		req.FundedBy = discountFundedByPlatform
+	case discountFundedByPlatform, discountFundedByOwner:
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid funded_by"))
+		return
+	}
+
+	campaign := Campaign{
+		ID:             ulid.Make().String(),
+		Name:           req.Name,
+		CodePattern:    req.CodePattern,
+		GrantOn:        req.GrantOn,
+		DiscountType:   req.DiscountType,
+		DiscountValue:  req.DiscountValue,
+		DiscountCap:    req.DiscountCap,
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   req.PerUserLimit,
+		Priority:       req.Priority,
+		FundedBy:       req.FundedBy,
+		CreatedAt:      time.Now(),
+	}
+	if req.StartsAt != nil {
+		t := time.UnixMilli(*req.StartsAt)
+		campaign.StartsAt = &t
+	}
+	if req.EndsAt != nil {
+		t := time.UnixMilli(*req.EndsAt)
+		campaign.EndsAt = &t
+	}
+	if campaign.StartsAt != nil && campaign.EndsAt != nil && !campaign.EndsAt.After(*campaign.StartsAt) {
+		writeError(w, http.StatusBadRequest, errors.New("ends_at must be after starts_at"))
+		return
+	}
+
+	if _, err := db.NamedExecContext(
+		ctx,
+		`INSERT INTO campaigns (id, name, code_pattern, grant_on, discount_type, discount_value, discount_cap, starts_at, ends_at, max_redemptions, per_user_limit, priority, funded_by, created_at)
+		VALUES (:id, :name, :code_pattern, :grant_on, :discount_type, :discount_value, :discount_cap, :starts_at, :ends_at, :max_redemptions, :per_user_limit, :priority, :funded_by, :created_at)`,
+		campaign,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &internalPostCampaignsResponse{ID: campaign.ID})
+}
+
+type internalPatchCampaignRequest struct {
+	DiscountValue  *int   `json:"discount_value"`
+	DiscountCap    *int   `json:"discount_cap"`
+	StartsAt       *int64 `json:"starts_at"`
+	EndsAt         *int64 `json:"ends_at"`
+	MaxRedemptions *int   `json:"max_redemptions"`
+	PerUserLimit   *int   `json:"per_user_limit"`
+	Priority       *int   `json:"priority"`
+}
+
+// 招待報酬の金額や招待数の上限などを運用中に変更するためのAPI
+func internalPatchCampaign(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	campaignID := r.PathValue("campaign_id")
+
+	req := &internalPatchCampaignRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaign := &Campaign{}
+	if err := tx.GetContext(ctx, campaign, "SELECT * FROM campaigns WHERE id = ? FOR UPDATE", campaignID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("campaign not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.DiscountValue != nil {
+		campaign.DiscountValue = *req.DiscountValue
+	}
+	if req.DiscountCap != nil {
+		campaign.DiscountCap = req.DiscountCap
+	}
+	if req.StartsAt != nil {
+		t := time.UnixMilli(*req.StartsAt)
+		campaign.StartsAt = &t
+	}
+	if req.EndsAt != nil {
+		t := time.UnixMilli(*req.EndsAt)
+		campaign.EndsAt = &t
+	}
+	if req.MaxRedemptions != nil {
+		campaign.MaxRedemptions = req.MaxRedemptions
+	}
+	if req.PerUserLimit != nil {
+		campaign.PerUserLimit = req.PerUserLimit
+	}
+	if req.Priority != nil {
+		campaign.Priority = *req.Priority
+	}
+
+	if campaign.DiscountValue <= 0 || (campaign.DiscountType == discountTypePercent && campaign.DiscountValue > 100) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid discount_value"))
+		return
+	}
+	if campaign.StartsAt != nil && campaign.EndsAt != nil && !campaign.EndsAt.After(*campaign.StartsAt) {
+		writeError(w, http.StatusBadRequest, errors.New("ends_at must be after starts_at"))
+		return
+	}
+
+	if _, err := tx.NamedExecContext(
+		ctx,
+		`UPDATE campaigns SET discount_value = :discount_value, discount_cap = :discount_cap, starts_at = :starts_at, ends_at = :ends_at,
+		max_redemptions = :max_redemptions, per_user_limit = :per_user_limit, priority = :priority WHERE id = :id`,
+		campaign,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalPostUserDeactivationRequest struct {
+	Reason string `json:"reason"`
+}
+
+// 不正利用などでユーザーを退会させる
+func internalPostUserDeactivation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := r.PathValue("user_id")
+
+	req := &internalPostUserDeactivationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
+	user := &User{}
+	if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO user_deactivations (user_id, reason) VALUES (?, ?) ON DUPLICATE KEY UPDATE reason = VALUES(reason)",
+		user.ID, req.Reason,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	TokenCache.Delete(user.AccessToken)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 運賃の決済を返金済みにする。決済サービスには返金APIが無いので、返金自体は別途行う
+func internalPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE ride_payments SET status = ? WHERE ride_id = ? AND kind = ? AND status = ?",
+		paymentStatusRefunded, ride.ID, paymentKindFare, paymentStatusSucceeded,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("paid ride not found"))
+		return
+	}
+
+	if err := removeRefundFromHourlySales(ctx, tx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalPostPayoutCloseRequest struct {
+	// 締める期間の開始日時 (UnixMilli)。指定が無ければ直前の期間
+	PeriodStart *int64 `json:"period_start"`
+}
+
+type internalPostPayoutCloseResponse struct {
+	PeriodStart int64 `json:"period_start"`
+	PeriodEnd   int64 `json:"period_end"`
+	Closed      int   `json:"closed"`
+}
+
+// 支払明細の締めを手動で行う。締め済みのオーナーはそのままにする
+func internalPostPayoutClose(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req := &internalPostPayoutCloseRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	period, err := getPayoutPeriod(ctx, db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end := lastPayoutPeriod(time.Now(), period)
+	if req.PeriodStart != nil {
+		start = time.UnixMilli(*req.PeriodStart).UTC()
+		if !salesBucketStart(start, period, time.UTC).Equal(start) {
+			writeError(w, http.StatusBadRequest, errors.New("period_start must be the start of a payout period"))
+			return
+		}
+		end = payoutPeriodEnd(start, period)
+		if end.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("payout period has not ended yet"))
+			return
+		}
+	}
+
+	closed, err := closePayoutPeriod(ctx, start, end)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &internalPostPayoutCloseResponse{
+		PeriodStart: start.UnixMilli(),
+		PeriodEnd:   end.UnixMilli(),
+		Closed:      closed,
+	})
+}
+
+type internalGetMetricsResponse struct {
+	ChairLocations chairLocationIngesterMetrics `json:"chair_locations"`
+}
+
+func internalGetMetrics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &internalGetMetricsResponse{
+		ChairLocations: chairLocationQueue.Metrics(),
+	})
+}
+
+type internalGetServiceAreasResponse struct {
+	ServiceAreas []serviceAreaResponse `json:"service_areas"`
+}
+
+func internalGetServiceAreas(w http.ResponseWriter, r *http.Request) {
+	areas, err := getServiceAreaResponses(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &internalGetServiceAreasResponse{ServiceAreas: areas})
+}
+
+type internalPostServiceAreasRequest struct {
+	Name     string       `json:"name"`
+	Shape    string       `json:"shape"`
+	Vertices []Coordinate `json:"vertices"`
+}
+
+type internalPostServiceAreasResponse struct {
+	ID string `json:"id"`
+}
+
+// サービスエリアを登録する。1つも無い間はどこでもライドを受け付ける
+func internalPostServiceAreas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalPostServiceAreasRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 64 {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1 to 64 characters"))
+		return
+	}
+	if err := validateServiceAreaShape(req.Shape, req.Vertices); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	vertices, err := json.Marshal(req.Vertices)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	id := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, "INSERT INTO service_areas (id, name, shape, vertices) VALUES (?, ?, ?, ?)", id, req.Name, req.Shape, string(vertices)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitServiceAreas(db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &internalPostServiceAreasResponse{ID: id})
+}
+
+// サービスエリアを削除する。このエリアを営業エリアにしていた椅子からも外す
+func internalDeleteServiceArea(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	serviceAreaID := r.PathValue("service_area_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM service_areas WHERE id = ?", serviceAreaID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("service area not found"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_service_areas WHERE service_area_id = ?", serviceAreaID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitServiceAreas(db); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"database/sql"
 	"encoding/json"
@@ -16,11 +17,15 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 var (
 	db                *sqlx.DB
 	latestChairStatus sync.Map
@@ -100,15 +105,72 @@ func InitTagsCache(db *sqlx.DB) {
 func main() {
 	mux := setup()
 
+	go chairLocationQueue.Run()
+
+	go func() {
+		for {
+			closeDuePayouts()
+			time.Sleep(payoutCloseInterval)
+		}
+	}()
+
+	go func() {
+		for {
+			sweepOfflineChairs()
+			time.Sleep(chairHeartbeatSweepInterval)
+		}
+	}()
+
+	go func() {
+		for {
+			sweepUnacknowledgedAssignments()
+			time.Sleep(rideAssignmentSweepInterval)
+		}
+	}()
+
+	go func() {
+		for {
+			syncChairMaintenance()
+			time.Sleep(chairMaintenanceSyncInterval)
+		}
+	}()
+
+	go func() {
+		for {
+			sweepChairAuthentications()
+			time.Sleep(chairAuthenticationSweepInterval)
+		}
+	}()
+
 	go func() {
 		for {
-			InsertChairLocations()
-			time.Sleep(100 * time.Millisecond)
+			enforceShiftLimits()
+			time.Sleep(chairShiftLimitSweepInterval)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		slog.Info("Listening on :8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve", "error", err)
+			stop()
 		}
 	}()
+	<-ctx.Done()
 
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	// 受け付け中のリクエストを終えてから、バッファに残っている位置情報を書き込む
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shutdown server", "error", err)
+	}
+	if err := chairLocationQueue.Close(shutdownCtx); err != nil {
+		slog.Error("failed to flush chair locations", "error", err, "remaining", chairLocationQueue.Metrics().QueueDepth)
+	}
 }
 
 func setup() http.Handler {
@@ -137,6 +199,12 @@ func setup() http.Handler {
 		dbname = "isuride"
 	}
 
+	internalAPIToken = os.Getenv("ISUCON_INTERNAL_API_TOKEN")
+	trustedProxies, err = parseTrustedProxies(os.Getenv("ISUCON_TRUSTED_PROXIES"))
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse ISUCON_TRUSTED_PROXIES environment variable: %v", err))
+	}
+
 	dbConfig := mysql.NewConfig()
 	dbConfig.User = user
 	dbConfig.Passwd = password
@@ -155,6 +223,18 @@ func setup() http.Handler {
 	db = _db
 
 	InitTagsCache(db)
+	if err := InitChairLocationStore(db); err != nil {
+		panic(err)
+	}
+	if err := InitChairSpatialIndex(db); err != nil {
+		panic(err)
+	}
+	if err := InitServiceAreas(db); err != nil {
+		panic(err)
+	}
+	if err := startShiftsOfActiveChairs(context.Background()); err != nil {
+		panic(err)
+	}
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
@@ -171,8 +251,13 @@ func setup() http.Handler {
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/receipt", appGetRideReceipt)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/tip", appPostRideTip)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("POST /api/app/coupons", appPostCoupons)
+		authedMux.HandleFunc("GET /api/app/referrals", appGetReferrals)
 	}
 
 	// owner handlers
@@ -180,8 +265,41 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
 		authedMux := mux.With(ownerAuthMiddleware)
-		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
-		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+
+		viewerMux := authedMux.With(ownerRoleMiddleware(ownerRoleViewer))
+		viewerMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		viewerMux.HandleFunc("GET /api/owner/sales/timeseries", ownerGetSalesTimeseries)
+		viewerMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		viewerMux.HandleFunc("GET /api/owner/chairs/{chair_id}", ownerGetChairDetail)
+		viewerMux.HandleFunc("GET /api/owner/chairs/{chair_id}/trail", ownerGetChairTrail)
+		viewerMux.HandleFunc("GET /api/owner/chairs/{chair_id}/maintenance", ownerGetChairMaintenance)
+		viewerMux.HandleFunc("GET /api/owner/chairs/{chair_id}/shifts", ownerGetChairShifts)
+		viewerMux.HandleFunc("GET /api/owner/rides/export", ownerGetRidesExport)
+		viewerMux.HandleFunc("GET /api/owner/payouts", ownerGetPayouts)
+		viewerMux.HandleFunc("GET /api/owner/payouts/{payout_id}", ownerGetPayout)
+		viewerMux.HandleFunc("GET /api/owner/evaluations", ownerGetEvaluations)
+		viewerMux.HandleFunc("GET /api/owner/evaluations/alert-setting", ownerGetRatingAlertSetting)
+		viewerMux.HandleFunc("GET /api/owner/service-areas", ownerGetServiceAreas)
+		viewerMux.HandleFunc("GET /api/owner/shift-limits", ownerGetShiftLimit)
+
+		// 椅子の受付停止とメンテナンスの予定は dispatcher から。それ以外の変更はハンドラ内で admin か確認する
+		dispatcherMux := authedMux.With(ownerRoleMiddleware(ownerRoleDispatcher))
+		dispatcherMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		dispatcherMux.HandleFunc("POST /api/owner/chairs/{chair_id}/maintenance", ownerPostChairMaintenance)
+		dispatcherMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}/maintenance/{maintenance_id}", ownerDeleteChairMaintenance)
+
+		adminMux := authedMux.With(ownerRoleMiddleware(ownerRoleAdmin))
+		adminMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", ownerDeleteChair)
+		adminMux.HandleFunc("POST /api/owner/chairs/{chair_id}/token", ownerPostChairToken)
+		adminMux.HandleFunc("PUT /api/owner/chairs/{chair_id}/service-areas", ownerPutChairServiceAreas)
+		adminMux.HandleFunc("GET /api/owner/chairs/authentications", ownerGetChairAuthentications)
+		adminMux.HandleFunc("POST /api/owner/chair-register-token", ownerPostChairRegisterToken)
+		adminMux.HandleFunc("PUT /api/owner/evaluations/alert-setting", ownerPutRatingAlertSetting)
+		adminMux.HandleFunc("PUT /api/owner/shift-limits", ownerPutShiftLimit)
+		adminMux.HandleFunc("GET /api/owner/staffs", ownerGetStaffs)
+		adminMux.HandleFunc("POST /api/owner/staffs", ownerPostStaffs)
+		adminMux.HandleFunc("PATCH /api/owner/staffs/{staff_id}", ownerPatchStaff)
+		adminMux.HandleFunc("DELETE /api/owner/staffs/{staff_id}", ownerDeleteStaff)
 	}
 
 	// chair handlers
@@ -198,6 +316,19 @@ func setup() http.Handler {
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+
+		// お金やアカウントに関わる操作は運営のトークンを持つリクエストだけ受け付ける
+		adminMux := mux.With(internalAuthMiddleware)
+		adminMux.HandleFunc("GET /api/internal/campaigns", internalGetCampaigns)
+		adminMux.HandleFunc("POST /api/internal/campaigns", internalPostCampaigns)
+		adminMux.HandleFunc("PATCH /api/internal/campaigns/{campaign_id}", internalPatchCampaign)
+		adminMux.HandleFunc("POST /api/internal/users/{user_id}/deactivation", internalPostUserDeactivation)
+		adminMux.HandleFunc("POST /api/internal/rides/{ride_id}/refund", internalPostRideRefund)
+		adminMux.HandleFunc("POST /api/internal/payouts/close", internalPostPayoutClose)
+		mux.HandleFunc("GET /api/internal/metrics", internalGetMetrics)
+		mux.HandleFunc("GET /api/internal/service-areas", internalGetServiceAreas)
+		adminMux.HandleFunc("POST /api/internal/service-areas", internalPostServiceAreas)
+		adminMux.HandleFunc("DELETE /api/internal/service-areas/{service_area_id}", internalDeleteServiceArea)
 	}
 
 	//mux.Handle("/debug/*", integration.NewDebugHandler())
@@ -220,8 +351,13 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
+	if err := chairLocationQueue.DiscardDuring(func() error {
+		if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to initialize: %s: %w", string(out), err)
+		}
+		return nil
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -230,6 +366,27 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	TokenCache.Clear()
+	chairAuthentications.Clear()
+	if err := rebuildHourlySales(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := startShiftsOfActiveChairs(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitChairLocationStore(db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitChairSpatialIndex(db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitServiceAreas(db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	//go func() {
 	//	if _, err := http.Get("http://localhost:9000/api/group/collect"); err != nil {
@@ -271,7 +428,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
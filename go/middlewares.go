@@ -2,14 +2,97 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 var TokenCache sync.Map
 
+// 運営向けの内部 API を呼ぶためのトークン。未設定なら内部 API は誰も呼べない
+var internalAPIToken string
+
+// X-Real-IP や X-Forwarded-For を信用するプロキシ。ここに無い相手から届いたヘッダーは無視する
+var trustedProxies []*net.IPNet
+
+// カンマ区切りの IP アドレスか CIDR を読む。未設定なら同じホストの nginx だけを信用する
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		s = "127.0.0.0/8,::1/128"
+	}
+	proxies := []*net.IPNet{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s: %w", v, err)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nginx を経由しているので、信用するプロキシから届いたリクエストだけ付与されたヘッダーを使う
+func remoteAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr = host
+	}
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return strings.TrimSpace(ip)
+	}
+	// 先頭はクライアントが自由に書けるので、右から見て信用するプロキシでない最初のアドレスを使う
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ips := strings.Split(forwarded, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if ip != "" && !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	return addr
+}
+
 func appAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -31,7 +114,7 @@ func appAuthMiddleware(next http.Handler) http.Handler {
 
 		// データベースから取得
 		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
+		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ? AND NOT EXISTS (SELECT 1 FROM user_deactivations WHERE user_id = users.id)", accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
@@ -60,20 +143,68 @@ func ownerAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		owner := &Owner{}
+		var staff *OwnerStaff
 		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			// オーナー本人でなければスタッフのトークンとして探す
+			staff = &OwnerStaff{}
+			if err := db.GetContext(ctx, staff, "SELECT * FROM owner_staffs WHERE access_token = ?", accessToken); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE id = ?", staff.OwnerID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
 		}
 
 		ctx = context.WithValue(ctx, "owner", owner)
+		ctx = context.WithValue(ctx, "staff", staff)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+const (
+	ownerRoleViewer     = "viewer"
+	ownerRoleDispatcher = "dispatcher"
+	ownerRoleAdmin      = "admin"
+)
+
+var ownerRoleLevels = map[string]int{
+	ownerRoleViewer:     1,
+	ownerRoleDispatcher: 2,
+	ownerRoleAdmin:      3,
+}
+
+// オーナー本人は admin として扱う
+func hasOwnerRole(ctx context.Context, role string) bool {
+	staff := ctx.Value("staff").(*OwnerStaff)
+	if staff == nil {
+		return true
+	}
+	return ownerRoleLevels[staff.Role] >= ownerRoleLevels[role]
+}
+
+func ownerRoleMiddleware(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasOwnerRole(r.Context(), role) {
+				writeError(w, http.StatusForbidden, errors.New("permission denied"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func chairAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -84,7 +215,7 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		}
 		accessToken := c.Value
 		chair := &Chair{}
-		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
+		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ? AND NOT EXISTS (SELECT 1 FROM chair_retirements WHERE chair_id = chairs.id)", accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
@@ -94,7 +225,31 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// トークンはキャッシュせず毎回引くので、ローテーションすると古いトークンは即座に使えなくなる
+		now := time.Now()
+		// 記録に失敗しても椅子のリクエストは止めない
+		if err := recordChairAuthentication(ctx, chair.ID, remoteAddr(r), now); err != nil {
+			log.Printf("failed to record chair authentication: %v", err)
+		}
+		chairIndex.Touch(chair.ID, now)
+
 		ctx = context.WithValue(ctx, "chair", chair)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// 運営向けの内部 API は Authorization: Bearer <ISUCON_INTERNAL_API_TOKEN> を持つリクエストだけ受け付ける
+func internalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, errors.New("bearer token is required"))
+			return
+		}
+		if internalAPIToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(internalAPIToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1,192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "spoofed header from untrusted peer", remoteAddr: "203.0.113.5:1234", realIP: "198.51.100.1", forwarded: "198.51.100.2", want: "203.0.113.5"},
+		{name: "real ip from trusted proxy", remoteAddr: "10.0.0.1:1234", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "forwarded from trusted proxy", remoteAddr: "192.168.1.1:1234", forwarded: "198.51.100.9, 198.51.100.2, 192.168.1.2", want: "198.51.100.2"},
+		{name: "trusted proxy without headers", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := remoteAddr(r); got != tt.want {
+				t.Errorf("remoteAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = nil })
+	if !isTrustedProxy("127.0.0.1") || !isTrustedProxy("::1") {
+		t.Error("loopback should be trusted by default")
+	}
+	if isTrustedProxy("10.0.0.1") {
+		t.Error("10.0.0.1 should not be trusted by default")
+	}
+	if _, err := parseTrustedProxies("not-an-ip"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
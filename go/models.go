@@ -69,6 +69,18 @@ type RideStatus struct {
 	ChairSentAt *time.Time `db:"chair_sent_at"`
 }
 
+type RideAssignment struct {
+	ID              string     `db:"id"`
+	RideID          string     `db:"ride_id"`
+	ChairID         string     `db:"chair_id"`
+	Result          *string    `db:"result"`
+	Reason          *string    `db:"reason"`
+	AssignedAt      time.Time  `db:"assigned_at"`
+	AckDeadline     time.Time  `db:"ack_deadline"`
+	RespondedAt     *time.Time `db:"responded_at"`
+	ChairNotifiedAt *time.Time `db:"chair_notified_at"`
+}
+
 type Owner struct {
 	ID                 string    `db:"id"`
 	Name               string    `db:"name"`
@@ -78,6 +90,16 @@ type Owner struct {
 	UpdatedAt          time.Time `db:"updated_at"`
 }
 
+type OwnerStaff struct {
+	ID          string    `db:"id"`
+	OwnerID     string    `db:"owner_id"`
+	Name        string    `db:"name"`
+	Role        string    `db:"role"`
+	AccessToken string    `db:"access_token"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
 type Coupon struct {
 	UserID    string    `db:"user_id"`
 	Code      string    `db:"code"`
@@ -85,3 +107,148 @@ type Coupon struct {
 	CreatedAt time.Time `db:"created_at"`
 	UsedBy    *string   `db:"used_by"`
 }
+
+type Campaign struct {
+	ID             string     `db:"id"`
+	Name           string     `db:"name"`
+	CodePattern    string     `db:"code_pattern"`
+	GrantOn        string     `db:"grant_on"`
+	DiscountType   string     `db:"discount_type"`
+	DiscountValue  int        `db:"discount_value"`
+	DiscountCap    *int       `db:"discount_cap"`
+	StartsAt       *time.Time `db:"starts_at"`
+	EndsAt         *time.Time `db:"ends_at"`
+	MaxRedemptions *int       `db:"max_redemptions"`
+	PerUserLimit   *int       `db:"per_user_limit"`
+	Priority       int        `db:"priority"`
+	FundedBy       string     `db:"funded_by"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+type RideFare struct {
+	RideID           string    `db:"ride_id"`
+	BaseFare         int       `db:"base_fare"`
+	Distance         int       `db:"distance"`
+	FarePerDistance  int       `db:"fare_per_distance"`
+	MeteredFare      int       `db:"metered_fare"`
+	CouponCode       *string   `db:"coupon_code"`
+	Discount         int       `db:"discount"`
+	DiscountFundedBy *string   `db:"discount_funded_by"`
+	Surcharge        int       `db:"surcharge"`
+	Fare             int       `db:"fare"`
+	DistanceBasis    string    `db:"distance_basis"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+type RideMeasurement struct {
+	RideID           string    `db:"ride_id"`
+	EnrouteDistance  int       `db:"enroute_distance"`
+	EnrouteDuration  *int64    `db:"enroute_duration"`
+	CarryingDistance int       `db:"carrying_distance"`
+	CarryingDuration *int64    `db:"carrying_duration"`
+	UpdatedAt        time.Time `db:"updated_at"`
+}
+
+type RidePayment struct {
+	RideID           string     `db:"ride_id"`
+	Kind             string     `db:"kind"`
+	Amount           int        `db:"amount"`
+	PaymentMethod    string     `db:"payment_method"`
+	TokenSuffix      string     `db:"token_suffix"`
+	Status           string     `db:"status"`
+	SalesBucketStart *time.Time `db:"sales_bucket_start"`
+	CreatedAt        time.Time  `db:"created_at"`
+	UpdatedAt        time.Time  `db:"updated_at"`
+}
+
+type ChairSalesHourly struct {
+	ChairID         string    `db:"chair_id"`
+	BucketStart     time.Time `db:"bucket_start"`
+	Rides           int       `db:"rides"`
+	Revenue         int       `db:"revenue"`
+	EvaluationTotal int       `db:"evaluation_total"`
+	EvaluationCount int       `db:"evaluation_count"`
+}
+
+type PayoutStatement struct {
+	ID          string    `db:"id"`
+	OwnerID     string    `db:"owner_id"`
+	PeriodStart time.Time `db:"period_start"`
+	PeriodEnd   time.Time `db:"period_end"`
+	salesBreakdown
+	RefundAdjustment int       `db:"refund_adjustment"`
+	Tips             int       `db:"tips"`
+	Payout           int       `db:"payout"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+type PayoutStatementItem struct {
+	StatementID string `db:"statement_id"`
+	ChairID     string `db:"chair_id"`
+	ChairName   string `db:"chair_name"`
+	ChairModel  string `db:"chair_model"`
+	salesBreakdown
+	RefundAdjustment int `db:"refund_adjustment"`
+	Tips             int `db:"tips"`
+	Payout           int `db:"payout"`
+}
+
+type OwnerRatingAlertSetting struct {
+	OwnerID    string    `db:"owner_id"`
+	Threshold  float64   `db:"threshold"`
+	WindowSize int       `db:"window_size"`
+	NotifyURL  *string   `db:"notify_url"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+type ChairRatingAlert struct {
+	ID          string     `db:"id"`
+	ChairID     string     `db:"chair_id"`
+	OwnerID     string     `db:"owner_id"`
+	Average     float64    `db:"average"`
+	Threshold   float64    `db:"threshold"`
+	WindowSize  int        `db:"window_size"`
+	CreatedAt   time.Time  `db:"created_at"`
+	DeliveredAt *time.Time `db:"delivered_at"`
+	ResolvedAt  *time.Time `db:"resolved_at"`
+}
+
+type ServiceArea struct {
+	ID        string    `db:"id"`
+	Name      string    `db:"name"`
+	Shape     string    `db:"shape"`
+	Vertices  string    `db:"vertices"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type ChairMaintenanceWindow struct {
+	ID         string     `db:"id"`
+	ChairID    string     `db:"chair_id"`
+	StartsAt   time.Time  `db:"starts_at"`
+	EndsAt     time.Time  `db:"ends_at"`
+	Reason     *string    `db:"reason"`
+	CreatedAt  time.Time  `db:"created_at"`
+	CanceledAt *time.Time `db:"canceled_at"`
+}
+
+type ChairShift struct {
+	ID        string     `db:"id"`
+	ChairID   string     `db:"chair_id"`
+	StartedAt time.Time  `db:"started_at"`
+	EndedAt   *time.Time `db:"ended_at"`
+	EndReason *string    `db:"end_reason"`
+}
+
+type OwnerShiftLimit struct {
+	OwnerID              string    `db:"owner_id"`
+	MaxContinuousMinutes int       `db:"max_continuous_minutes"`
+	MinBreakMinutes      int       `db:"min_break_minutes"`
+	UpdatedAt            time.Time `db:"updated_at"`
+}
+
+type ChairOwnership struct {
+	ChairID   string     `db:"chair_id"`
+	OwnerID   string     `db:"owner_id"`
+	StartedAt time.Time  `db:"started_at"`
+	EndedAt   *time.Time `db:"ended_at"`
+}
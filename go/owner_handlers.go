@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -66,39 +75,55 @@ type chairSales struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
 	Sales int    `json:"sales"`
+	Tips  int    `json:"tips"`
+	salesBreakdown
 }
 
 type modelSales struct {
 	Model string `json:"model"`
 	Sales int    `json:"sales"`
+	Tips  int    `json:"tips"`
+	salesBreakdown
 }
 
 type ownerGetSalesResponse struct {
-	TotalSales int          `json:"total_sales"`
-	Chairs     []chairSales `json:"chairs"`
-	Models     []modelSales `json:"models"`
+	TotalSales       int          `json:"total_sales"`
+	TotalNet         int          `json:"total_net"`
+	TotalPlatformFee int          `json:"total_platform_fee"`
+	TotalTips        int          `json:"total_tips"`
+	Chairs           []chairSales `json:"chairs"`
+	Models           []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// クエリパラメータの since, until (UnixMilli) を読む。指定が無ければ全期間
+func parseSinceUntil(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
+
+// sales はこれまでどおり割引前の運賃の合計を返す。オーナーの取り分(割引・返金・手数料を引いた額)は net で返す
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	owner := r.Context().Value("owner").(*Owner)
 
@@ -109,71 +134,286 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	periods, err := getOwnedChairPeriods(ctx, tx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	platformFeePercent, err := getPlatformFeePercent(ctx, tx)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	res := ownerGetSalesResponse{
 		TotalSales: 0,
+		Chairs:     []chairSales{},
 	}
 
-	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	// 移管された椅子は、このオーナーが持っていた期間の売上だけを数える
+	chairSalesByID := map[string]*chairSales{}
+	chairIDs := []string{}
+	modelSalesByModel := map[string]*modelSales{}
+	modelNames := []string{}
+	for _, period := range periods {
+		from, to, overlaps := period.clip(since, until)
+		// 今持っている椅子は、期間に売上が無くても返す
+		if !overlaps && period.OwnedUntil != nil {
+			continue
 		}
 
-		sales := sumSales(rides)
-		res.TotalSales += sales
+		breakdown := salesBreakdown{}
+		tips := 0
+		if overlaps {
+			breakdown, err = getChairSalesBreakdown(ctx, tx, period.ID, from, to, platformFeePercent)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			// チップは評価の後からも送られるので、決済された日時で集計する
+			if err := tx.GetContext(ctx, &tips, "SELECT IFNULL(SUM(ride_payments.amount), 0) FROM ride_payments JOIN rides ON rides.id = ride_payments.ride_id WHERE rides.chair_id = ? AND ride_payments.kind = 'tip' AND ride_payments.status = 'succeeded' AND ride_payments.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", period.ID, from, to); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		res.TotalSales += breakdown.GrossFare
+		res.TotalNet += breakdown.Net
+		res.TotalPlatformFee += breakdown.PlatformFee
+		res.TotalTips += tips
 
-		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
-		})
+		c, ok := chairSalesByID[period.ID]
+		if !ok {
+			c = &chairSales{ID: period.ID, Name: period.Name}
+			chairSalesByID[period.ID] = c
+			chairIDs = append(chairIDs, period.ID)
+		}
+		c.Sales += breakdown.GrossFare
+		c.Tips += tips
+		c.add(breakdown)
 
-		modelSalesByModel[chair.Model] += sales
+		m, ok := modelSalesByModel[period.Model]
+		if !ok {
+			m = &modelSales{Model: period.Model}
+			modelSalesByModel[period.Model] = m
+			modelNames = append(modelNames, period.Model)
+		}
+		m.Sales += breakdown.GrossFare
+		m.Tips += tips
+		m.add(breakdown)
+	}
+	for _, chairID := range chairIDs {
+		res.Chairs = append(res.Chairs, *chairSalesByID[chairID])
 	}
 
 	models := []modelSales{}
-	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
-			Model: model,
-			Sales: sales,
-		})
+	for _, model := range modelNames {
+		models = append(models, *modelSalesByModel[model])
 	}
 	res.Models = models
 
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
-	}
-	return sale
+type salesTimeseriesBucket struct {
+	Start         int64    `json:"start"`
+	Rides         int      `json:"rides"`
+	Revenue       int      `json:"revenue"`
+	EvaluationAvg *float64 `json:"evaluation_avg"`
+
+	evaluationTotal int
+	evaluationCount int
 }
 
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+type ownerGetSalesTimeseriesResponse struct {
+	Granularity string                                 `json:"granularity"`
+	TZ          string                                 `json:"tz"`
+	Chairs      []ownerGetSalesTimeseriesResponseChair `json:"chairs"`
+	Models      []ownerGetSalesTimeseriesResponseModel `json:"models"`
+}
+
+type ownerGetSalesTimeseriesResponseChair struct {
+	ID      string                  `json:"id"`
+	Name    string                  `json:"name"`
+	Model   string                  `json:"model"`
+	Buckets []salesTimeseriesBucket `json:"buckets"`
+}
+
+type ownerGetSalesTimeseriesResponseModel struct {
+	Model   string                  `json:"model"`
+	Buckets []salesTimeseriesBucket `json:"buckets"`
+}
+
+// 1時間単位の集計テーブルから、指定された粒度とタイムゾーンのバケットに積み直して返す。
+// 集計は1時間単位なので、UTCとの時差が1時間単位でないタイムゾーンでは境界がずれる
+func ownerGetSalesTimeseries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	granularity := r.URL.Query().Get("granularity")
+	switch granularity {
+	case "":
+		granularity = "day"
+	case "hour", "day", "week", "month":
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("granularity must be one of hour, day, week, month"))
+		return
+	}
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("tz is invalid"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	periods, err := getOwnedChairPeriods(ctx, tx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairs := []Chair{}
+	periodsByChair := map[string][]ownedChairPeriod{}
+	for _, period := range periods {
+		if _, ok := periodsByChair[period.ID]; !ok {
+			chairs = append(chairs, period.Chair)
+		}
+		periodsByChair[period.ID] = append(periodsByChair[period.ID], period)
+	}
+
+	// 移管された椅子は、このオーナーが持っていた期間の集計だけを使う
+	hourly := []ChairSalesHourly{}
+	if len(chairs) > 0 {
+		chairIDs := make([]string, 0, len(chairs))
+		for _, chair := range chairs {
+			chairIDs = append(chairIDs, chair.ID)
+		}
+		query, args, err := sqlx.In(
+			"SELECT * FROM chair_sales_hourly WHERE chair_id IN (?) AND bucket_start BETWEEN ? AND ? ORDER BY bucket_start",
+			chairIDs, since.Truncate(time.Hour), until,
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		rows := []ChairSalesHourly{}
+		if err := tx.SelectContext(ctx, &rows, tx.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, h := range rows {
+			for _, period := range periodsByChair[h.ChairID] {
+				if period.containsHourlyBucket(h.BucketStart) {
+					hourly = append(hourly, h)
+					break
+				}
+			}
+		}
+	}
+
+	platformFeePercent, err := getPlatformFeePercent(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type bucketKey struct {
+		key   string
+		start int64
+	}
+	buckets := map[bucketKey]*salesTimeseriesBucket{}
+	order := map[string][]int64{}
+	add := func(key string, h ChairSalesHourly) {
+		start := salesBucketStart(h.BucketStart, granularity, loc).UnixMilli()
+		b, ok := buckets[bucketKey{key, start}]
+		if !ok {
+			b = &salesTimeseriesBucket{Start: start}
+			buckets[bucketKey{key, start}] = b
+			order[key] = append(order[key], start)
+		}
+		b.Rides += h.Rides
+		b.Revenue += h.Revenue
+		b.evaluationTotal += h.EvaluationTotal
+		b.evaluationCount += h.EvaluationCount
+	}
+	collect := func(key string) []salesTimeseriesBucket {
+		res := []salesTimeseriesBucket{}
+		for _, start := range order[key] {
+			b := buckets[bucketKey{key, start}]
+			b.Revenue = applyPlatformFee(b.Revenue, platformFeePercent)
+			if b.evaluationCount > 0 {
+				avg := float64(b.evaluationTotal) / float64(b.evaluationCount)
+				b.EvaluationAvg = &avg
+			}
+			res = append(res, *b)
+		}
+		return res
+	}
+
+	chairModels := map[string]string{}
+	for _, chair := range chairs {
+		chairModels[chair.ID] = chair.Model
+	}
+	for _, h := range hourly {
+		add("chair:"+h.ChairID, h)
+		add("model:"+chairModels[h.ChairID], h)
+	}
+
+	res := ownerGetSalesTimeseriesResponse{
+		Granularity: granularity,
+		TZ:          tz,
+		Chairs:      []ownerGetSalesTimeseriesResponseChair{},
+		Models:      []ownerGetSalesTimeseriesResponseModel{},
+	}
+	seenModels := map[string]bool{}
+	for _, chair := range chairs {
+		res.Chairs = append(res.Chairs, ownerGetSalesTimeseriesResponseChair{
+			ID:      chair.ID,
+			Name:    chair.Name,
+			Model:   chair.Model,
+			Buckets: collect("chair:" + chair.ID),
+		})
+		if !seenModels[chair.Model] {
+			seenModels[chair.Model] = true
+			res.Models = append(res.Models, ownerGetSalesTimeseriesResponseModel{
+				Model:   chair.Model,
+				Buckets: collect("model:" + chair.Model),
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
 }
 
 type chairWithDetail struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	ID          string       `db:"id"`
+	OwnerID     string       `db:"owner_id"`
+	Name        string       `db:"name"`
+	AccessToken string       `db:"access_token"`
+	Model       string       `db:"model"`
+	IsActive    bool         `db:"is_active"`
+	CreatedAt   time.Time    `db:"created_at"`
+	UpdatedAt   time.Time    `db:"updated_at"`
+	RetiredAt   sql.NullTime `db:"retired_at"`
 }
 
 type ownerGetChairResponse struct {
@@ -188,6 +428,10 @@ type ownerGetChairResponseChair struct {
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
+	Online                 bool   `json:"online"`
+	// 営業エリアの外から位置を報告しているか
+	OutOfArea bool `json:"out_of_area"`
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
@@ -203,10 +447,9 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
        is_active,
        chairs.created_at,
        updated_at,
-       IFNULL(distance_table.total_distance ,0) as total_distance,
-       distance_table.created_at as total_distance_updated_at	
+       chair_retirements.created_at as retired_at
 FROM chairs
-       LEFT JOIN latest_chair_locations AS distance_table ON distance_table.chair_id = chairs.id
+       LEFT JOIN chair_retirements ON chair_retirements.chair_id = chairs.id
 WHERE owner_id = ?
 `, owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -216,18 +459,2169 @@ WHERE owner_id = ?
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
-		}
-		if chair.TotalDistanceUpdatedAt.Valid {
-			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
+			ID:           chair.ID,
+			Name:         chair.Name,
+			Model:        chair.Model,
+			Active:       chair.IsActive,
+			RegisteredAt: chair.CreatedAt.UnixMilli(),
+			Online:       chairIndex.IsOnline(chair.ID),
+			OutOfArea:    isChairOutsideArea(chair.ID),
+		}
+		// 総移動距離は位置を受け付けた時点でメモリ上に足しているので、そちらを返す
+		if location, ok := getChairLocation(chair.ID); ok {
+			t := location.UpdatedAt.UnixMilli()
+			c.TotalDistance = location.TotalDistance
 			c.TotalDistanceUpdatedAt = &t
 		}
+		if chair.RetiredAt.Valid {
+			t := chair.RetiredAt.Time.UnixMilli()
+			c.RetiredAt = &t
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerRideExportRow struct {
+	RideID               string        `db:"ride_id"`
+	ChairID              string        `db:"chair_id"`
+	ChairName            string        `db:"chair_name"`
+	ChairModel           string        `db:"chair_model"`
+	PickupLatitude       int           `db:"pickup_latitude"`
+	PickupLongitude      int           `db:"pickup_longitude"`
+	DestinationLatitude  int           `db:"destination_latitude"`
+	DestinationLongitude int           `db:"destination_longitude"`
+	Evaluation           sql.NullInt64 `db:"evaluation"`
+	RequestedAt          time.Time     `db:"requested_at"`
+	CompletedAt          time.Time     `db:"completed_at"`
+	Fare                 sql.NullInt64 `db:"fare"`
+	FareDistance         sql.NullInt64 `db:"fare_distance"`
+	Discount             sql.NullInt64 `db:"discount"`
+	CouponDiscount       int           `db:"coupon_discount"`
+	EnrouteDistance      sql.NullInt64 `db:"enroute_distance"`
+	EnrouteDuration      sql.NullInt64 `db:"enroute_duration"`
+	CarryingDistance     sql.NullInt64 `db:"carrying_distance"`
+	CarryingDuration     sql.NullInt64 `db:"carrying_duration"`
+}
+
+type ownerRideExportLine struct {
+	RideID                string                   `json:"ride_id"`
+	ChairID               string                   `json:"chair_id"`
+	ChairName             string                   `json:"chair_name"`
+	ChairModel            string                   `json:"chair_model"`
+	PickupCoordinate      Coordinate               `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate               `json:"destination_coordinate"`
+	Distance              int                      `json:"distance"`
+	Fare                  int                      `json:"fare"`
+	Discount              int                      `json:"discount"`
+	Evaluation            *int                     `json:"evaluation"`
+	RequestedAt           int64                    `json:"requested_at"`
+	CompletedAt           int64                    `json:"completed_at"`
+	Measured              *rideMeasurementResponse `json:"measured"`
+}
+
+var ownerRideExportCSVHeader = []string{
+	"ride_id", "chair_id", "chair_name", "chair_model",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"distance", "fare", "discount", "evaluation", "requested_at", "completed_at",
+	"enroute_distance", "enroute_duration_ms", "carrying_distance", "carrying_duration_ms",
+}
+
+func (row *ownerRideExportRow) line() ownerRideExportLine {
+	l := ownerRideExportLine{
+		RideID:                row.RideID,
+		ChairID:               row.ChairID,
+		ChairName:             row.ChairName,
+		ChairModel:            row.ChairModel,
+		PickupCoordinate:      Coordinate{Latitude: row.PickupLatitude, Longitude: row.PickupLongitude},
+		DestinationCoordinate: Coordinate{Latitude: row.DestinationLatitude, Longitude: row.DestinationLongitude},
+		Distance:              calculateDistance(row.PickupLatitude, row.PickupLongitude, row.DestinationLatitude, row.DestinationLongitude),
+		RequestedAt:           row.RequestedAt.UnixMilli(),
+		CompletedAt:           row.CompletedAt.UnixMilli(),
+	}
+	if row.Fare.Valid {
+		l.Distance = int(row.FareDistance.Int64)
+		l.Fare = int(row.Fare.Int64)
+		l.Discount = int(row.Discount.Int64)
+	} else {
+		// 運賃の内訳が保存される前のライドは、紐づいたクーポンから求める
+		meteredFare := farePerDistance * l.Distance
+		l.Discount = min(row.CouponDiscount, meteredFare)
+		l.Fare = initialFare + meteredFare - l.Discount
+	}
+	if row.Evaluation.Valid {
+		e := int(row.Evaluation.Int64)
+		l.Evaluation = &e
+	}
+	if row.EnrouteDistance.Valid {
+		m := &RideMeasurement{
+			EnrouteDistance:  int(row.EnrouteDistance.Int64),
+			CarryingDistance: int(row.CarryingDistance.Int64),
+		}
+		if row.EnrouteDuration.Valid {
+			m.EnrouteDuration = &row.EnrouteDuration.Int64
+		}
+		if row.CarryingDuration.Valid {
+			m.CarryingDuration = &row.CarryingDuration.Int64
+		}
+		l.Measured = newRideMeasurementResponse(m)
+	}
+	return l
+}
+
+func (l *ownerRideExportLine) csvRecord() []string {
+	evaluation := ""
+	if l.Evaluation != nil {
+		evaluation = strconv.Itoa(*l.Evaluation)
+	}
+	// 測れていない値は空にする
+	measured := []string{"", "", "", ""}
+	if m := l.Measured; m != nil {
+		measured[0] = strconv.Itoa(m.EnrouteDistance)
+		measured[2] = strconv.Itoa(m.CarryingDistance)
+		if m.EnrouteDurationMs != nil {
+			measured[1] = strconv.FormatInt(*m.EnrouteDurationMs, 10)
+		}
+		if m.CarryingDurationMs != nil {
+			measured[3] = strconv.FormatInt(*m.CarryingDurationMs, 10)
+		}
+	}
+	return append([]string{
+		l.RideID, l.ChairID, l.ChairName, l.ChairModel,
+		strconv.Itoa(l.PickupCoordinate.Latitude), strconv.Itoa(l.PickupCoordinate.Longitude),
+		strconv.Itoa(l.DestinationCoordinate.Latitude), strconv.Itoa(l.DestinationCoordinate.Longitude),
+		strconv.Itoa(l.Distance), strconv.Itoa(l.Fare), strconv.Itoa(l.Discount), evaluation,
+		time.UnixMilli(l.RequestedAt).UTC().Format(time.RFC3339Nano),
+		time.UnixMilli(l.CompletedAt).UTC().Format(time.RFC3339Nano),
+	}, measured...)
+}
+
+// オーナーの椅子の完了したライドを書き出す。椅子が多くてもメモリに載せないよう、1行ずつ読みながら書き出す
+func ownerGetRidesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be csv or jsonl"))
+		return
+	}
+
+	rows, err := db.QueryxContext(
+		ctx,
+		`SELECT
+			rides.id AS ride_id,
+			chairs.id AS chair_id,
+			chairs.name AS chair_name,
+			chairs.model AS chair_model,
+			rides.pickup_latitude,
+			rides.pickup_longitude,
+			rides.destination_latitude,
+			rides.destination_longitude,
+			rides.evaluation,
+			rides.created_at AS requested_at,
+			rides.updated_at AS completed_at,
+			ride_fares.fare,
+			ride_fares.distance AS fare_distance,
+			ride_fares.discount,
+			IFNULL(coupons.discount, 0) AS coupon_discount,
+			ride_measurements.enroute_distance,
+			ride_measurements.enroute_duration,
+			ride_measurements.carrying_distance,
+			ride_measurements.carrying_duration
+		FROM rides
+			JOIN chairs ON chairs.id = rides.chair_id
+			JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id
+			LEFT JOIN ride_fares ON ride_fares.ride_id = rides.id
+			LEFT JOIN coupons ON coupons.used_by = rides.id
+			LEFT JOIN ride_measurements ON ride_measurements.ride_id = rides.id
+		WHERE `+rideOwnedBySQL+` AND latest_ride_statuses.status = 'COMPLETED' AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		ORDER BY rides.updated_at`,
+		owner.ID, owner.ID, since, until,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson;charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rides.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	jsonEncoder := json.NewEncoder(w)
+	if format == "csv" {
+		csvWriter.Write(ownerRideExportCSVHeader)
+	}
+
+	// ヘッダーを送った後なのでエラーはステータスコードで返せない。書けた分を送ってから接続を切り、
+	// 途中で打ち切られたことがクライアントに分かるようにする
+	abort := func(err error) {
+		log.Printf("failed to export rides: %v", err)
+		csvWriter.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	count := 0
+	for rows.Next() {
+		row := ownerRideExportRow{}
+		if err := rows.StructScan(&row); err != nil {
+			abort(err)
+		}
+		line := row.line()
+		if format == "csv" {
+			err = csvWriter.Write(line.csvRecord())
+		} else {
+			err = jsonEncoder.Encode(line)
+		}
+		if err != nil {
+			abort(err)
+		}
+
+		count++
+		if count%100 == 0 {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				abort(err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		abort(err)
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		abort(err)
+	}
+}
+
+const (
+	chairAuditActionRename             = "rename"
+	chairAuditActionChangeModel        = "change_model"
+	chairAuditActionDeactivate         = "deactivate"
+	chairAuditActionRetire             = "retire"
+	chairAuditActionTransfer           = "transfer"
+	chairAuditActionRotateToken        = "rotate_token"
+	chairAuditActionChangeServiceAreas = "change_service_areas"
+)
+
+// 操作したスタッフはコンテキストから取る
+func insertChairAuditLog(ctx context.Context, tx *sqlx.Tx, chairID, ownerID, action string, before, after *string) error {
+	var staffID *string
+	if staff := ctx.Value("staff").(*OwnerStaff); staff != nil {
+		staffID = &staff.ID
+	}
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO chair_audit_logs (id, chair_id, owner_id, staff_id, action, before_value, after_value) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		ulid.Make().String(), chairID, ownerID, staffID, action, before, after,
+	)
+	return err
+}
+
+// オーナーの椅子を行ロックして取得する。引退済みの椅子は変更できないので 409 を返す
+func lockOwnerChair(ctx context.Context, tx *sqlx.Tx, ownerID, chairID string) (*Chair, int, error) {
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? FOR UPDATE", chairID, ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, errors.New("chair not found")
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var retired bool
+	if err := tx.GetContext(ctx, &retired, "SELECT EXISTS (SELECT 1 FROM chair_retirements WHERE chair_id = ?)", chair.ID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if retired {
+		return nil, http.StatusConflict, errors.New("chair is already retired")
+	}
+	return chair, 0, nil
+}
+
+type ownerPatchChairRequest struct {
+	Name     *string `json:"name"`
+	Model    *string `json:"model"`
+	IsActive *bool   `json:"is_active"`
+	OwnerID  *string `json:"owner_id"`
+}
+
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name != nil && (*req.Name == "" || utf8.RuneCountInString(*req.Name) > 30) {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1 to 30 characters"))
+		return
+	}
+	if req.Model != nil && *req.Model == "" {
+		writeError(w, http.StatusBadRequest, errors.New("model must not be empty"))
+		return
+	}
+	// 受付の再開は椅子自身が行うので、オーナーからは停止のみできる
+	if req.IsActive != nil && *req.IsActive {
+		writeError(w, http.StatusBadRequest, errors.New("owners can only deactivate chairs"))
+		return
+	}
+	// 受付の停止は dispatcher から、それ以外の変更は admin のみできる
+	if (req.Name != nil || req.Model != nil || req.OwnerID != nil) && !hasOwnerRole(ctx, ownerRoleAdmin) {
+		writeError(w, http.StatusForbidden, errors.New("permission denied"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if req.Name != nil && *req.Name != chair.Name {
+		if _, err := tx.ExecContext(ctx, "UPDATE chairs SET name = ? WHERE id = ?", *req.Name, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionRename, &chair.Name, req.Name); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if req.Model != nil && *req.Model != chair.Model {
+		// 配車はモデルの速度を使うので、登録されていないモデルにすると配車されなくなる
+		var known bool
+		if err := tx.GetContext(ctx, &known, "SELECT EXISTS (SELECT 1 FROM chair_models WHERE name = ?)", *req.Model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !known {
+			writeError(w, http.StatusBadRequest, errors.New("unknown chair model"))
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE chairs SET model = ? WHERE id = ?", *req.Model, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionChangeModel, &chair.Model, req.Model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	deactivated := false
+	if req.IsActive != nil && chair.IsActive {
+		// 椅子自身が停止するときと同じく、ライドの途中ならライドが終わってから受付停止にする
+		busy, err := chairHasActiveRide(ctx, tx, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if busy {
+			if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO chair_pending_deactivations (chair_id) VALUES (?)", chair.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chair.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := endChairShift(ctx, tx, chair.ID, time.Now(), chairShiftEndReasonDeactivated); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			deactivated = true
+		}
+		if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionDeactivate, nil, nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// 移管前の売上は移管元に、移管後の売上は移管先に計上されるよう、所有期間を記録する
+	if req.OwnerID != nil && *req.OwnerID != chair.OwnerID {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM owners WHERE id = ?)", *req.OwnerID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusBadRequest, errors.New("transfer destination owner not found"))
+			return
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE chairs SET owner_id = ? WHERE id = ?", *req.OwnerID, chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := recordChairTransfer(ctx, tx, chair, *req.OwnerID, time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionTransfer, &chair.OwnerID, req.OwnerID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if deactivated {
+		chairIndex.SetActive(chair.ID, false)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 椅子を引退させる。走行履歴や売上は残したまま、以降は配車も認証もされなくなる
+func ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	var hasActiveRide bool
+	if err := tx.GetContext(
+		ctx,
+		&hasActiveRide,
+		`SELECT EXISTS (
+			SELECT 1 FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id
+			WHERE rides.chair_id = ? AND latest_ride_statuses.status <> 'COMPLETED'
+		)`,
+		chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if hasActiveRide {
+		writeError(w, http.StatusConflict, errors.New("chair has an active ride"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chair_retirements (chair_id) VALUES (?)", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := endChairShift(ctx, tx, chair.ID, time.Now(), chairShiftEndReasonRetired); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionRetire, nil, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairIndex.SetActive(chair.ID, false)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// 椅子のアクセストークンを再発行する。古いトークンは即座に無効になる
+func ownerPostChairToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	accessToken := secureRandomStr(32)
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionRotateToken, nil, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	chairAuthentications.Delete(chair.ID)
+
+	writeJSON(w, http.StatusOK, &ownerPostChairTokenResponse{
+		AccessToken: accessToken,
+	})
+}
+
+type ownerGetServiceAreasResponse struct {
+	ServiceAreas []serviceAreaResponse `json:"service_areas"`
+}
+
+func ownerGetServiceAreas(w http.ResponseWriter, r *http.Request) {
+	areas, err := getServiceAreaResponses(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerGetServiceAreasResponse{ServiceAreas: areas})
+}
+
+type ownerPutChairServiceAreasRequest struct {
+	ServiceAreaIDs []string `json:"service_area_ids"`
+}
+
+// 椅子の営業エリアを置き換える。空にするとサービスエリア内ならどこでも営業できる
+func ownerPutChairServiceAreas(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPutChairServiceAreasRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	areaIDs := []string{}
+	seen := map[string]bool{}
+	for _, id := range req.ServiceAreaIDs {
+		if !seen[id] {
+			seen[id] = true
+			areaIDs = append(areaIDs, id)
+		}
+	}
+	sort.Strings(areaIDs)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if len(areaIDs) > 0 {
+		query, args, err := sqlx.In("SELECT COUNT(*) FROM service_areas WHERE id IN (?)", areaIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		var count int
+		if err := tx.GetContext(ctx, &count, tx.Rebind(query), args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if count != len(areaIDs) {
+			writeError(w, http.StatusBadRequest, errors.New("unknown service area"))
+			return
+		}
+	}
+
+	before := []string{}
+	if err := tx.SelectContext(ctx, &before, "SELECT service_area_id FROM chair_service_areas WHERE chair_id = ? ORDER BY service_area_id", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_service_areas WHERE chair_id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, id := range areaIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO chair_service_areas (chair_id, service_area_id) VALUES (?, ?)", chair.ID, id); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	beforeValue := strings.Join(before, ",")
+	afterValue := strings.Join(areaIDs, ",")
+	if err := insertChairAuditLog(ctx, tx, chair.ID, owner.ID, chairAuditActionChangeServiceAreas, &beforeValue, &afterValue); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := InitServiceAreas(db); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerChairMaintenance struct {
+	ID         string  `json:"id"`
+	StartsAt   int64   `json:"starts_at"`
+	EndsAt     int64   `json:"ends_at"`
+	Reason     *string `json:"reason"`
+	CreatedAt  int64   `json:"created_at"`
+	CanceledAt *int64  `json:"canceled_at,omitempty"`
+}
+
+type ownerGetChairMaintenanceResponse struct {
+	Maintenance []ownerChairMaintenance `json:"maintenance"`
+}
+
+func ownerGetChairMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ?", chairID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	windows := []ChairMaintenanceWindow{}
+	if err := db.SelectContext(ctx, &windows, "SELECT * FROM chair_maintenance_windows WHERE chair_id = ? ORDER BY starts_at", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairMaintenanceResponse{Maintenance: []ownerChairMaintenance{}}
+	for _, window := range windows {
+		item := ownerChairMaintenance{
+			ID:        window.ID,
+			StartsAt:  window.StartsAt.UnixMilli(),
+			EndsAt:    window.EndsAt.UnixMilli(),
+			Reason:    window.Reason,
+			CreatedAt: window.CreatedAt.UnixMilli(),
+		}
+		if window.CanceledAt != nil {
+			t := window.CanceledAt.UnixMilli()
+			item.CanceledAt = &t
+		}
+		res.Maintenance = append(res.Maintenance, item)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostChairMaintenanceRequest struct {
+	StartsAt int64   `json:"starts_at"`
+	EndsAt   int64   `json:"ends_at"`
+	Reason   *string `json:"reason"`
+}
+
+type ownerPostChairMaintenanceResponse struct {
+	ID string `json:"id"`
+}
+
+// メンテナンスを予定する。始まる前から、それまでに終えられないライドは割り当てなくなる
+func ownerPostChairMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPostChairMaintenanceRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	startsAt := time.UnixMilli(req.StartsAt)
+	endsAt := time.UnixMilli(req.EndsAt)
+	if !endsAt.After(startsAt) {
+		writeError(w, http.StatusBadRequest, errors.New("ends_at must be after starts_at"))
+		return
+	}
+	if !endsAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, errors.New("ends_at must be in the future"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	var overlapped bool
+	if err := tx.GetContext(
+		ctx,
+		&overlapped,
+		"SELECT EXISTS (SELECT 1 FROM chair_maintenance_windows WHERE chair_id = ? AND canceled_at IS NULL AND starts_at < ? AND ends_at > ?)",
+		chair.ID, endsAt, startsAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if overlapped {
+		writeError(w, http.StatusConflict, errors.New("maintenance overlaps with another one"))
+		return
+	}
+
+	id := ulid.Make().String()
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO chair_maintenance_windows (id, chair_id, starts_at, ends_at, reason) VALUES (?, ?, ?, ?, ?)",
+		id, chair.ID, startsAt, endsAt, req.Reason,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	syncChairMaintenance()
+
+	writeJSON(w, http.StatusCreated, &ownerPostChairMaintenanceResponse{ID: id})
+}
+
+// 終わっていないメンテナンスを取り消す
+func ownerDeleteChairMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+	maintenanceID := r.PathValue("maintenance_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, status, err := lockOwnerChair(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	window := &ChairMaintenanceWindow{}
+	if err := tx.GetContext(ctx, window, "SELECT * FROM chair_maintenance_windows WHERE id = ? AND chair_id = ? FOR UPDATE", maintenanceID, chair.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("maintenance not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if window.CanceledAt != nil || !window.EndsAt.After(time.Now()) {
+		writeError(w, http.StatusConflict, errors.New("maintenance has already been canceled or finished"))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_maintenance_windows SET canceled_at = CURRENT_TIMESTAMP(6) WHERE id = ?", window.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	syncChairMaintenance()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerChairShift struct {
+	ID        string  `json:"id"`
+	StartedAt int64   `json:"started_at"`
+	EndedAt   *int64  `json:"ended_at"`
+	EndReason *string `json:"end_reason"`
+	OnlineMs  int64   `json:"online_ms"`
+	BusyMs    int64   `json:"busy_ms"`
+	IdleMs    int64   `json:"idle_ms"`
+	Rides     int     `json:"rides"`
+	// ライドを終えてから次のライドに向かい始めるまでの平均。ライドが2件に満たなければ null
+	AverageIdleBetweenRidesMs *int64 `json:"average_idle_between_rides_ms"`
+	Distance                  int    `json:"distance"`
+	Revenue                   int    `json:"revenue"`
+}
+
+type ownerGetChairShiftsResponseTotal struct {
+	OnlineMs int64 `json:"online_ms"`
+	BusyMs   int64 `json:"busy_ms"`
+	IdleMs   int64 `json:"idle_ms"`
+	Rides    int   `json:"rides"`
+	Distance int   `json:"distance"`
+	Revenue  int   `json:"revenue"`
+}
+
+type ownerGetChairShiftsResponse struct {
+	Shifts []ownerChairShift                `json:"shifts"`
+	Total  ownerGetChairShiftsResponseTotal `json:"total"`
+}
+
+// 期間と重なるシフトごとの集計。集計はシフト全体について行い、受付中のシフトは現在までとする。
+// ライドに向かい始めてから目的地に着くまでを稼働中、シフト中に目的地に着いたライドをそのシフトで運んだライドとし、
+// 売上はシフト中に決済されたライドのオーナーの取り分とする
+func ownerGetChairShifts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM chairs WHERE id = ? AND owner_id = ?)", chairID, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	shifts := []ChairShift{}
+	if err := tx.SelectContext(
+		ctx,
+		&shifts,
+		"SELECT * FROM chair_shifts WHERE chair_id = ? AND started_at <= ? + INTERVAL 999 MICROSECOND AND (ended_at IS NULL OR ended_at >= ?) ORDER BY started_at",
+		chairID, until, since,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairShiftsResponse{Shifts: []ownerChairShift{}}
+	if len(shifts) == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	now := time.Now()
+	shiftEnd := func(shift ChairShift) time.Time {
+		if shift.EndedAt != nil {
+			return *shift.EndedAt
+		}
+		return now
+	}
+	from, to := shifts[0].StartedAt, shiftEnd(shifts[len(shifts)-1])
+
+	// ライドごとに、向かい始めてから目的地に着くまで(進行中なら現在まで)の区間にする
+	var statuses []struct {
+		RideID    string    `db:"ride_id"`
+		Status    string    `db:"status"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if err := tx.SelectContext(
+		ctx,
+		&statuses,
+		`SELECT ride_statuses.ride_id, ride_statuses.status, ride_statuses.created_at
+		FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id
+		WHERE rides.chair_id = ? AND rides.created_at <= ? AND rides.updated_at >= ?
+		ORDER BY ride_statuses.ride_id, ride_statuses.created_at`,
+		chairID, to, from,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	type busySpan struct {
+		start   time.Time
+		end     time.Time
+		arrived bool
+	}
+	spans := []busySpan{}
+	for i, s := range statuses {
+		if s.Status != "ENROUTE" {
+			continue
+		}
+		span := busySpan{start: s.CreatedAt, end: now}
+		for j := i + 1; j < len(statuses) && statuses[j].RideID == s.RideID; j++ {
+			if statuses[j].Status == "ARRIVED" {
+				span.end = statuses[j].CreatedAt
+				span.arrived = true
+				break
+			}
+		}
+		spans = append(spans, span)
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start.Before(spans[j].start)
+	})
+
+	var locations []struct {
+		Latitude  int       `db:"latitude"`
+		Longitude int       `db:"longitude"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if err := tx.SelectContext(
+		ctx,
+		&locations,
+		"SELECT latitude, longitude, created_at FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY created_at",
+		chairID, from, to,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	platformFeePercent, err := getPlatformFeePercent(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	l := 0
+	for _, shift := range shifts {
+		start, end := shift.StartedAt, shiftEnd(shift)
+		item := ownerChairShift{
+			ID:        shift.ID,
+			StartedAt: start.UnixMilli(),
+			EndReason: shift.EndReason,
+			OnlineMs:  end.Sub(start).Milliseconds(),
+		}
+		if shift.EndedAt != nil {
+			t := shift.EndedAt.UnixMilli()
+			item.EndedAt = &t
+		}
+
+		var busy, idle time.Duration
+		var lastArrival *time.Time
+		gaps := 0
+		for _, span := range spans {
+			if span.end.Before(start) || span.start.After(end) {
+				continue
+			}
+			busyStart, busyEnd := span.start, span.end
+			if busyStart.Before(start) {
+				busyStart = start
+			}
+			if busyEnd.After(end) {
+				busyEnd = end
+			}
+			busy += busyEnd.Sub(busyStart)
+			if lastArrival != nil && !span.start.Before(*lastArrival) {
+				idle += span.start.Sub(*lastArrival)
+				gaps++
+			}
+			if span.arrived && !span.end.After(end) {
+				item.Rides++
+				arrival := span.end
+				lastArrival = &arrival
+			} else {
+				lastArrival = nil
+			}
+		}
+		item.BusyMs = busy.Milliseconds()
+		item.IdleMs = max(item.OnlineMs-item.BusyMs, 0)
+		if gaps > 0 {
+			average := (idle / time.Duration(gaps)).Milliseconds()
+			item.AverageIdleBetweenRidesMs = &average
+		}
+
+		for l < len(locations) && locations[l].CreatedAt.Before(start) {
+			l++
+		}
+		for ; l+1 < len(locations) && !locations[l+1].CreatedAt.After(end); l++ {
+			item.Distance += calculateDistance(locations[l].Latitude, locations[l].Longitude, locations[l+1].Latitude, locations[l+1].Longitude)
+		}
+
+		sales, err := getChairSalesBreakdown(ctx, tx, chairID, start, end, platformFeePercent)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		item.Revenue = sales.Net
+
+		res.Shifts = append(res.Shifts, item)
+		res.Total.OnlineMs += item.OnlineMs
+		res.Total.BusyMs += item.BusyMs
+		res.Total.IdleMs += item.IdleMs
+		res.Total.Rides += item.Rides
+		res.Total.Distance += item.Distance
+		res.Total.Revenue += item.Revenue
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerShiftLimit struct {
+	MaxContinuousMinutes int `json:"max_continuous_minutes"`
+	MinBreakMinutes      int `json:"min_break_minutes"`
+}
+
+func ownerGetShiftLimit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	limit, err := getOwnerShiftLimit(ctx, db, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerShiftLimit{
+		MaxContinuousMinutes: limit.MaxContinuousMinutes,
+		MinBreakMinutes:      limit.MinBreakMinutes,
+	})
+}
+
+// max_continuous_minutes を 0 にすると上限を外す
+func ownerPutShiftLimit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerShiftLimit{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.MaxContinuousMinutes < 0 || req.MaxContinuousMinutes > maxShiftLimitMinutes {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("max_continuous_minutes must be between 0 and %d", maxShiftLimitMinutes))
+		return
+	}
+	if req.MinBreakMinutes < 0 || req.MinBreakMinutes > maxShiftLimitMinutes {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("min_break_minutes must be between 0 and %d", maxShiftLimitMinutes))
+		return
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO owner_shift_limits (owner_id, max_continuous_minutes, min_break_minutes) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE max_continuous_minutes = VALUES(max_continuous_minutes), min_break_minutes = VALUES(min_break_minutes)`,
+		owner.ID, req.MaxContinuousMinutes, req.MinBreakMinutes,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+// 椅子登録用のトークンを再発行する。登録済みの椅子には影響しない
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairRegisterToken := secureRandomStr(32)
+	if _, err := db.ExecContext(ctx, "UPDATE owners SET chair_register_token = ? WHERE id = ?", chairRegisterToken, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerPostChairRegisterTokenResponse{
+		ChairRegisterToken: chairRegisterToken,
+	})
+}
+
+type ownerGetChairAuthenticationsResponse struct {
+	Authentications []ownerGetChairAuthenticationsResponseItem `json:"authentications"`
+}
+
+type ownerGetChairAuthenticationsResponseItem struct {
+	ChairID         string `json:"chair_id"`
+	ChairName       string `json:"chair_name"`
+	RemoteAddr      string `json:"remote_addr"`
+	AuthenticatedAt int64  `json:"authenticated_at"`
+}
+
+// 最近の椅子の認証の記録を新しい順に返す。同じ接続元からの認証は1分に1回だけ記録している
+func ownerGetChairAuthentications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since := time.Now().Add(-1 * time.Hour)
+	if s := r.URL.Query().Get("since"); s != "" {
+		parsed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+
+	var authentications []struct {
+		ChairID         string    `db:"chair_id"`
+		ChairName       string    `db:"chair_name"`
+		RemoteAddr      string    `db:"remote_addr"`
+		AuthenticatedAt time.Time `db:"authenticated_at"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&authentications,
+		`SELECT chair_authentications.chair_id, chairs.name AS chair_name, chair_authentications.remote_addr, chair_authentications.authenticated_at
+		FROM chair_authentications JOIN chairs ON chairs.id = chair_authentications.chair_id
+		WHERE chairs.owner_id = ? AND chair_authentications.authenticated_at >= ?
+		ORDER BY chair_authentications.authenticated_at DESC
+		LIMIT ?`,
+		owner.ID, since, maxChairAuthentications,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairAuthenticationsResponse{
+		Authentications: []ownerGetChairAuthenticationsResponseItem{},
+	}
+	for _, auth := range authentications {
+		res.Authentications = append(res.Authentications, ownerGetChairAuthenticationsResponseItem{
+			ChairID:         auth.ChairID,
+			ChairName:       auth.ChairName,
+			RemoteAddr:      auth.RemoteAddr,
+			AuthenticatedAt: auth.AuthenticatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+const (
+	defaultRecentEvaluations = 10
+	maxRecentEvaluations     = 100
+	recentRejections         = 10
+)
+
+type ownerGetChairDetailResponse struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Model             string   `json:"model"`
+	Active            bool     `json:"active"`
+	RegisteredAt      int64    `json:"registered_at"`
+	RetiredAt         *int64   `json:"retired_at,omitempty"`
+	ServiceAreaIDs    []string `json:"service_area_ids"`
+	OutOfArea         bool     `json:"out_of_area"`
+	TotalDistance     int      `json:"total_distance"`
+	CurrentRideStatus *string  `json:"current_ride_status"`
+	// ライドが終わるのを待っている受付停止の理由。requested か forced_break
+	PendingDeactivation *string                                       `json:"pending_deactivation"`
+	Rides               int                                           `json:"rides"`
+	Evaluation          ownerGetChairDetailResponseEvaluation         `json:"evaluation"`
+	Sales               salesBreakdown                                `json:"sales"`
+	Tips                int                                           `json:"tips"`
+	Utilisation         ownerGetChairDetailResponseUtilisation        `json:"utilisation"`
+	RecentEvaluations   []ownerGetChairDetailResponseRecentEvaluation `json:"recent_evaluations"`
+	Assignments         ownerGetChairDetailResponseAssignments        `json:"assignments"`
+	RecentRejections    []ownerGetChairDetailResponseRecentRejection  `json:"recent_rejections"`
+}
+
+type ownerGetChairDetailResponseEvaluation struct {
+	Average      *float64    `json:"average"`
+	Count        int         `json:"count"`
+	Distribution map[int]int `json:"distribution"`
+}
+
+type ownerGetChairDetailResponseUtilisation struct {
+	EnrouteMs  int64   `json:"enroute_ms"`
+	CarryingMs int64   `json:"carrying_ms"`
+	IdleMs     int64   `json:"idle_ms"`
+	Rate       float64 `json:"rate"`
+}
+
+// 割り当てへの応答の集計。率は応答済み(期限切れを含む)の割り当てに対する割合で、まだ応答が無ければ null
+type ownerGetChairDetailResponseAssignments struct {
+	Assigned       int      `db:"assigned" json:"assigned"`
+	Accepted       int      `db:"accepted" json:"accepted"`
+	Rejected       int      `db:"rejected" json:"rejected"`
+	TimedOut       int      `db:"timed_out" json:"timed_out"`
+	AcceptanceRate *float64 `json:"acceptance_rate"`
+	RejectionRate  *float64 `json:"rejection_rate"`
+	TimeoutRate    *float64 `json:"timeout_rate"`
+}
+
+type ownerGetChairDetailResponseRecentRejection struct {
+	RideID     string `json:"ride_id"`
+	Reason     string `json:"reason"`
+	RejectedAt int64  `json:"rejected_at"`
+}
+
+type ownerGetChairDetailResponseRecentEvaluation struct {
+	RideID      string `json:"ride_id"`
+	Evaluation  int    `json:"evaluation"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+func ownerGetChairDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	limit := defaultRecentEvaluations
+	if s := r.URL.Query().Get("evaluations"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxRecentEvaluations {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("evaluations must be between 0 and %d", maxRecentEvaluations))
+			return
+		}
+		limit = n
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair := chairWithDetail{}
+	if err := tx.GetContext(ctx, &chair, `SELECT chairs.id,
+       owner_id,
+       name,
+       access_token,
+       model,
+       is_active,
+       chairs.created_at,
+       updated_at,
+       chair_retirements.created_at as retired_at
+FROM chairs
+       LEFT JOIN chair_retirements ON chair_retirements.chair_id = chairs.id
+WHERE chairs.id = ? AND owner_id = ?
+`, chairID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	res := ownerGetChairDetailResponse{
+		ID:             chair.ID,
+		Name:           chair.Name,
+		Model:          chair.Model,
+		Active:         chair.IsActive,
+		RegisteredAt:   chair.CreatedAt.UnixMilli(),
+		ServiceAreaIDs: getChairServiceAreaIDs(chair.ID),
+		OutOfArea:      isChairOutsideArea(chair.ID),
+		Evaluation: ownerGetChairDetailResponseEvaluation{
+			Distribution: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0},
+		},
+		RecentEvaluations: []ownerGetChairDetailResponseRecentEvaluation{},
+		RecentRejections:  []ownerGetChairDetailResponseRecentRejection{},
+	}
+	if location, ok := getChairLocation(chair.ID); ok {
+		res.TotalDistance = location.TotalDistance
+	}
+	var pendingDeactivation string
+	if err := tx.GetContext(ctx, &pendingDeactivation, "SELECT reason FROM chair_pending_deactivations WHERE chair_id = ?", chair.ID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		res.PendingDeactivation = &pendingDeactivation
+	}
+	if chair.RetiredAt.Valid {
+		t := chair.RetiredAt.Time.UnixMilli()
+		res.RetiredAt = &t
+	}
+	if status, ok := getLatestChairStatus(chair.ID); ok {
+		res.CurrentRideStatus = &status.Status
+	}
+
+	if err := tx.GetContext(ctx, &res.Rides, "SELECT COUNT(*) FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id WHERE rides.chair_id = ? AND latest_ride_statuses.status = 'COMPLETED'", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var distribution []struct {
+		Evaluation int `db:"evaluation"`
+		Count      int `db:"count"`
+	}
+	if err := tx.SelectContext(ctx, &distribution, "SELECT evaluation, COUNT(*) AS count FROM rides WHERE chair_id = ? AND evaluation IS NOT NULL GROUP BY evaluation", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	total := 0
+	for _, d := range distribution {
+		res.Evaluation.Distribution[d.Evaluation] = d.Count
+		res.Evaluation.Count += d.Count
+		total += d.Evaluation * d.Count
+	}
+	if res.Evaluation.Count > 0 {
+		avg := float64(total) / float64(res.Evaluation.Count)
+		res.Evaluation.Average = &avg
+	}
+
+	platformFeePercent, err := getPlatformFeePercent(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 移管を受けた椅子は、移管されてからの分だけを返す
+	ownedSince, err := getChairOwnedSince(ctx, tx, chair.ID, chair.CreatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.Sales, err = getChairSalesBreakdown(ctx, tx, chair.ID, ownedSince, now, platformFeePercent)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, &res.Tips, "SELECT IFNULL(SUM(ride_payments.amount), 0) FROM ride_payments JOIN rides ON rides.id = ride_payments.ride_id WHERE rides.chair_id = ? AND ride_payments.kind = 'tip' AND ride_payments.status = 'succeeded' AND ride_payments.updated_at >= ?", chair.ID, ownedSince); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 各状態にいた時間は、次の状態に変わるまで(進行中なら現在まで)として求める
+	var statuses []struct {
+		RideID    string    `db:"ride_id"`
+		Status    string    `db:"status"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if err := tx.SelectContext(ctx, &statuses, "SELECT ride_statuses.ride_id, ride_statuses.status, ride_statuses.created_at FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id WHERE rides.chair_id = ? ORDER BY ride_statuses.ride_id, ride_statuses.created_at", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var enroute, carrying time.Duration
+	for i, s := range statuses {
+		end := now
+		if i+1 < len(statuses) && statuses[i+1].RideID == s.RideID {
+			end = statuses[i+1].CreatedAt
+		}
+		switch s.Status {
+		case "ENROUTE", "PICKUP":
+			enroute += end.Sub(s.CreatedAt)
+		case "CARRYING":
+			carrying += end.Sub(s.CreatedAt)
+		}
+	}
+	registered := now.Sub(chair.CreatedAt)
+	if chair.RetiredAt.Valid {
+		registered = chair.RetiredAt.Time.Sub(chair.CreatedAt)
+	}
+	res.Utilisation = ownerGetChairDetailResponseUtilisation{
+		EnrouteMs:  enroute.Milliseconds(),
+		CarryingMs: carrying.Milliseconds(),
+		IdleMs:     max(registered-enroute-carrying, 0).Milliseconds(),
+	}
+	if registered > 0 {
+		res.Utilisation.Rate = float64(enroute+carrying) / float64(registered)
+	}
+
+	if limit > 0 {
+		var reviews []struct {
+			RideID      string    `db:"id"`
+			Evaluation  int       `db:"evaluation"`
+			CompletedAt time.Time `db:"updated_at"`
+		}
+		if err := tx.SelectContext(ctx, &reviews, "SELECT id, evaluation, updated_at FROM rides WHERE chair_id = ? AND evaluation IS NOT NULL ORDER BY updated_at DESC LIMIT ?", chair.ID, limit); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, review := range reviews {
+			res.RecentEvaluations = append(res.RecentEvaluations, ownerGetChairDetailResponseRecentEvaluation{
+				RideID:      review.RideID,
+				Evaluation:  review.Evaluation,
+				CompletedAt: review.CompletedAt.UnixMilli(),
+			})
+		}
+	}
+
+	if err := tx.GetContext(
+		ctx,
+		&res.Assignments,
+		"SELECT COUNT(*) AS assigned, IFNULL(SUM(result = ?), 0) AS accepted, IFNULL(SUM(result = ?), 0) AS rejected, IFNULL(SUM(result = ?), 0) AS timed_out FROM ride_assignments WHERE chair_id = ?",
+		rideAssignmentResultAccepted, rideAssignmentResultRejected, rideAssignmentResultTimeout, chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if responded := res.Assignments.Accepted + res.Assignments.Rejected + res.Assignments.TimedOut; responded > 0 {
+		acceptance := float64(res.Assignments.Accepted) / float64(responded)
+		rejection := float64(res.Assignments.Rejected) / float64(responded)
+		timeout := float64(res.Assignments.TimedOut) / float64(responded)
+		res.Assignments.AcceptanceRate = &acceptance
+		res.Assignments.RejectionRate = &rejection
+		res.Assignments.TimeoutRate = &timeout
+	}
+
+	rejections := []RideAssignment{}
+	if err := tx.SelectContext(ctx, &rejections, "SELECT * FROM ride_assignments WHERE chair_id = ? AND result = ? ORDER BY responded_at DESC LIMIT ?", chair.ID, rideAssignmentResultRejected, recentRejections); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, rejection := range rejections {
+		res.RecentRejections = append(res.RecentRejections, ownerGetChairDetailResponseRecentRejection{
+			RideID:     rejection.RideID,
+			Reason:     *rejection.Reason,
+			RejectedAt: rejection.RespondedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+const (
+	defaultTrailPoints = 1000
+	maxTrailPoints     = 10000
+)
+
+type ownerGetChairTrailResponse struct {
+	Points   []ownerGetChairTrailResponsePoint   `json:"points"`
+	Segments []ownerGetChairTrailResponseSegment `json:"segments"`
+	// 間引く前の点の数
+	TotalPoints int `json:"total_points"`
+}
+
+type ownerGetChairTrailResponsePoint struct {
+	Coordinate
+	RecordedAt int64   `json:"recorded_at"`
+	RideID     *string `json:"ride_id,omitempty"`
+	RideStatus *string `json:"ride_status,omitempty"`
+}
+
+// 椅子がライドのある状態にいた区間。進行中の区間は end が無い
+type ownerGetChairTrailResponseSegment struct {
+	RideID string `json:"ride_id"`
+	Status string `json:"status"`
+	Start  int64  `json:"start"`
+	End    *int64 `json:"end,omitempty"`
+}
+
+// 椅子の移動経路を時刻順に返す。点が多い場合は等間隔に間引くが、区間は間引かずに全て返す
+func ownerGetChairTrail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	maxPoints := defaultTrailPoints
+	if s := r.URL.Query().Get("max_points"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 || n > maxTrailPoints {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("max_points must be between 2 and %d", maxTrailPoints))
+			return
+		}
+		maxPoints = n
+	}
+
+	var exists bool
+	if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM chairs WHERE id = ? AND owner_id = ?)", chairID, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	// 期間と重なるライドの状態を取り、MATCHING と到着後を除いた区間にする
+	var statuses []struct {
+		RideID    string    `db:"ride_id"`
+		Status    string    `db:"status"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&statuses,
+		`SELECT ride_statuses.ride_id, ride_statuses.status, ride_statuses.created_at
+		FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id
+		WHERE rides.chair_id = ? AND rides.created_at <= ? + INTERVAL 999 MICROSECOND AND rides.updated_at >= ?
+		ORDER BY ride_statuses.ride_id, ride_statuses.created_at`,
+		chairID, until, since,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	segments := []ownerGetChairTrailResponseSegment{}
+	for i, s := range statuses {
+		if s.Status != "ENROUTE" && s.Status != "PICKUP" && s.Status != "CARRYING" {
+			continue
+		}
+		segment := ownerGetChairTrailResponseSegment{
+			RideID: s.RideID,
+			Status: s.Status,
+			Start:  s.CreatedAt.UnixMilli(),
+		}
+		if i+1 < len(statuses) && statuses[i+1].RideID == s.RideID {
+			end := statuses[i+1].CreatedAt.UnixMilli()
+			segment.End = &end
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+
+	res := ownerGetChairTrailResponse{
+		Points:   []ownerGetChairTrailResponsePoint{},
+		Segments: segments,
+	}
+	if err := db.GetContext(ctx, &res.TotalPoints, "SELECT COUNT(*) FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chairID, since, until); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if res.TotalPoints == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	// 最初と最後の点は必ず残す
+	stride := 1
+	if res.TotalPoints > maxPoints {
+		stride = (res.TotalPoints - 1 + maxPoints - 2) / (maxPoints - 1)
+	}
+
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND ORDER BY created_at", chairID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	i := 0
+	segmentIndex := 0
+	for rows.Next() {
+		location := ChairLocation{}
+		if err := rows.StructScan(&location); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		last := i == res.TotalPoints-1
+		i++
+		if (i-1)%stride != 0 && !last {
+			continue
+		}
+
+		point := ownerGetChairTrailResponsePoint{
+			Coordinate: Coordinate{Latitude: location.Latitude, Longitude: location.Longitude},
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		}
+		for segmentIndex < len(segments) && segments[segmentIndex].End != nil && *segments[segmentIndex].End <= point.RecordedAt {
+			segmentIndex++
+		}
+		if segmentIndex < len(segments) && segments[segmentIndex].Start <= point.RecordedAt {
+			point.RideID = &segments[segmentIndex].RideID
+			point.RideStatus = &segments[segmentIndex].Status
+		}
+		res.Points = append(res.Points, point)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerStaff struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ownerGetStaffsResponse struct {
+	Staffs []ownerStaff `json:"staffs"`
+}
+
+func ownerGetStaffs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	staffs := []OwnerStaff{}
+	if err := db.SelectContext(ctx, &staffs, "SELECT * FROM owner_staffs WHERE owner_id = ? ORDER BY created_at", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetStaffsResponse{Staffs: []ownerStaff{}}
+	for _, staff := range staffs {
+		res.Staffs = append(res.Staffs, ownerStaff{
+			ID:        staff.ID,
+			Name:      staff.Name,
+			Role:      staff.Role,
+			CreatedAt: staff.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerPostStaffsRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type ownerPostStaffsResponse struct {
+	ID          string `json:"id"`
+	AccessToken string `json:"access_token"`
+}
+
+// スタッフを登録する。返したアクセストークンを owner_session として使うと、スタッフとしてログインできる
+func ownerPostStaffs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostStaffsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 30 {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1 to 30 characters"))
+		return
+	}
+	if _, ok := ownerRoleLevels[req.Role]; !ok {
+		writeError(w, http.StatusBadRequest, errors.New("role must be viewer, dispatcher or admin"))
+		return
+	}
+
+	staffID := ulid.Make().String()
+	accessToken := secureRandomStr(32)
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO owner_staffs (id, owner_id, name, role, access_token) VALUES (?, ?, ?, ?, ?)",
+		staffID, owner.ID, req.Name, req.Role, accessToken,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &ownerPostStaffsResponse{
+		ID:          staffID,
+		AccessToken: accessToken,
+	})
+}
+
+type ownerPatchStaffRequest struct {
+	Role string `json:"role"`
+}
+
+func ownerPatchStaff(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	staffID := r.PathValue("staff_id")
+
+	req := &ownerPatchStaffRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := ownerRoleLevels[req.Role]; !ok {
+		writeError(w, http.StatusBadRequest, errors.New("role must be viewer, dispatcher or admin"))
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE owner_staffs SET role = ? WHERE id = ? AND owner_id = ?", req.Role, staffID, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		var exists bool
+		if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM owner_staffs WHERE id = ? AND owner_id = ?)", staffID, owner.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, errors.New("staff not found"))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// スタッフを削除する。セッションはキャッシュしていないので即座に使えなくなる
+func ownerDeleteStaff(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	staffID := r.PathValue("staff_id")
+
+	result, err := db.ExecContext(ctx, "DELETE FROM owner_staffs WHERE id = ? AND owner_id = ?", staffID, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusNotFound, errors.New("staff not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerPayout struct {
+	ID          string `json:"id"`
+	PeriodStart int64  `json:"period_start"`
+	PeriodEnd   int64  `json:"period_end"`
+	salesBreakdown
+	RefundAdjustment int   `json:"refund_adjustment"`
+	Tips             int   `json:"tips"`
+	Payout           int   `json:"payout"`
+	ClosedAt         int64 `json:"closed_at"`
+}
+
+func newOwnerPayout(statement *PayoutStatement) ownerPayout {
+	return ownerPayout{
+		ID:               statement.ID,
+		PeriodStart:      statement.PeriodStart.UnixMilli(),
+		PeriodEnd:        statement.PeriodEnd.UnixMilli(),
+		salesBreakdown:   statement.salesBreakdown,
+		RefundAdjustment: statement.RefundAdjustment,
+		Tips:             statement.Tips,
+		Payout:           statement.Payout,
+		ClosedAt:         statement.CreatedAt.UnixMilli(),
+	}
+}
+
+type ownerGetPayoutsResponse struct {
+	Payouts []ownerPayout `json:"payouts"`
+}
+
+func ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	statements := []PayoutStatement{}
+	if err := db.SelectContext(ctx, &statements, "SELECT * FROM payout_statements WHERE owner_id = ? ORDER BY period_start DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetPayoutsResponse{Payouts: []ownerPayout{}}
+	for i := range statements {
+		res.Payouts = append(res.Payouts, newOwnerPayout(&statements[i]))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetPayoutResponse struct {
+	ownerPayout
+	Items []ownerGetPayoutResponseItem `json:"items"`
+}
+
+type ownerGetPayoutResponseItem struct {
+	ChairID    string `json:"chair_id"`
+	ChairName  string `json:"chair_name"`
+	ChairModel string `json:"chair_model"`
+	salesBreakdown
+	RefundAdjustment int `json:"refund_adjustment"`
+	Tips             int `json:"tips"`
+	Payout           int `json:"payout"`
+}
+
+func ownerGetPayout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	payoutID := r.PathValue("payout_id")
+
+	statement := &PayoutStatement{}
+	if err := db.GetContext(ctx, statement, "SELECT * FROM payout_statements WHERE id = ? AND owner_id = ?", payoutID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payout not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := []PayoutStatementItem{}
+	if err := db.SelectContext(ctx, &items, "SELECT * FROM payout_statement_items WHERE statement_id = ? ORDER BY chair_id", statement.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetPayoutResponse{
+		ownerPayout: newOwnerPayout(statement),
+		Items:       []ownerGetPayoutResponseItem{},
+	}
+	for _, item := range items {
+		res.Items = append(res.Items, ownerGetPayoutResponseItem{
+			ChairID:          item.ChairID,
+			ChairName:        item.ChairName,
+			ChairModel:       item.ChairModel,
+			salesBreakdown:   item.salesBreakdown,
+			RefundAdjustment: item.RefundAdjustment,
+			Tips:             item.Tips,
+			Payout:           item.Payout,
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+const (
+	defaultWorstRides = 10
+	maxWorstRides     = 100
+)
+
+type evaluationSummary struct {
+	Count        int         `json:"count"`
+	Average      *float64    `json:"average"`
+	Distribution map[int]int `json:"distribution"`
+	total        int
+}
+
+func newEvaluationSummary() *evaluationSummary {
+	return &evaluationSummary{
+		Distribution: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0},
+	}
+}
+
+func (s *evaluationSummary) add(evaluation int) {
+	s.Count++
+	s.total += evaluation
+	s.Distribution[evaluation]++
+	avg := float64(s.total) / float64(s.Count)
+	s.Average = &avg
+}
+
+type ownerGetEvaluationsResponse struct {
+	evaluationSummary
+	Chairs     []ownerGetEvaluationsResponseChair     `json:"chairs"`
+	Models     []ownerGetEvaluationsResponseModel     `json:"models"`
+	Trend      []ownerGetEvaluationsResponseTrend     `json:"trend"`
+	WorstRides []ownerGetEvaluationsResponseWorstRide `json:"worst_rides"`
+	Alerts     []ownerRatingAlert                     `json:"alerts"`
+}
+
+type ownerGetEvaluationsResponseChair struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	*evaluationSummary
+}
+
+type ownerGetEvaluationsResponseModel struct {
+	Model string `json:"model"`
+	*evaluationSummary
+}
+
+type ownerGetEvaluationsResponseTrend struct {
+	Start int64 `json:"start"`
+	*evaluationSummary
+}
+
+type ownerGetEvaluationsResponseWorstRide struct {
+	RideID      string `json:"ride_id"`
+	ChairID     string `json:"chair_id"`
+	ChairName   string `json:"chair_name"`
+	Evaluation  int    `json:"evaluation"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+type ownerRatingAlert struct {
+	ID          string  `json:"id"`
+	ChairID     string  `json:"chair_id"`
+	Average     float64 `json:"average"`
+	Threshold   float64 `json:"threshold"`
+	WindowSize  int     `json:"window_size"`
+	CreatedAt   int64   `json:"created_at"`
+	DeliveredAt *int64  `json:"delivered_at,omitempty"`
+	ResolvedAt  *int64  `json:"resolved_at,omitempty"`
+}
+
+// 期間内に評価されたライドの評価を、椅子・モデル・期間ごとに集計する
+func ownerGetEvaluations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+	if granularity != "hour" && granularity != "day" && granularity != "week" && granularity != "month" {
+		writeError(w, http.StatusBadRequest, errors.New("granularity must be one of hour, day, week, month"))
+		return
+	}
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	worst := defaultWorstRides
+	if s := r.URL.Query().Get("worst"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxWorstRides {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("worst must be between 0 and %d", maxWorstRides))
+			return
+		}
+		worst = n
+	}
+
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? ORDER BY created_at", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var evaluations []struct {
+		ChairID     string    `db:"chair_id"`
+		Evaluation  int       `db:"evaluation"`
+		CompletedAt time.Time `db:"updated_at"`
+	}
+	if err := db.SelectContext(
+		ctx,
+		&evaluations,
+		`SELECT rides.chair_id, rides.evaluation, rides.updated_at FROM rides JOIN chairs ON chairs.id = rides.chair_id
+		WHERE chairs.owner_id = ? AND rides.evaluation IS NOT NULL AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		ORDER BY rides.updated_at`,
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetEvaluationsResponse{
+		evaluationSummary: *newEvaluationSummary(),
+		Chairs:            []ownerGetEvaluationsResponseChair{},
+		Models:            []ownerGetEvaluationsResponseModel{},
+		Trend:             []ownerGetEvaluationsResponseTrend{},
+		WorstRides:        []ownerGetEvaluationsResponseWorstRide{},
+		Alerts:            []ownerRatingAlert{},
+	}
+
+	byChair := map[string]*evaluationSummary{}
+	byModel := map[string]*evaluationSummary{}
+	for _, chair := range chairs {
+		byChair[chair.ID] = newEvaluationSummary()
+		if _, ok := byModel[chair.Model]; !ok {
+			byModel[chair.Model] = newEvaluationSummary()
+			res.Models = append(res.Models, ownerGetEvaluationsResponseModel{
+				Model:             chair.Model,
+				evaluationSummary: byModel[chair.Model],
+			})
+		}
+		res.Chairs = append(res.Chairs, ownerGetEvaluationsResponseChair{
+			ID:                chair.ID,
+			Name:              chair.Name,
+			Model:             chair.Model,
+			evaluationSummary: byChair[chair.ID],
+		})
+	}
+	modelOf := map[string]string{}
+	for _, chair := range chairs {
+		modelOf[chair.ID] = chair.Model
+	}
+
+	// ライドは完了日時順なので、バケットも古い順に並ぶ
+	for _, e := range evaluations {
+		res.evaluationSummary.add(e.Evaluation)
+		byChair[e.ChairID].add(e.Evaluation)
+		byModel[modelOf[e.ChairID]].add(e.Evaluation)
+
+		start := salesBucketStart(e.CompletedAt, granularity, loc).UnixMilli()
+		if len(res.Trend) == 0 || res.Trend[len(res.Trend)-1].Start != start {
+			res.Trend = append(res.Trend, ownerGetEvaluationsResponseTrend{
+				Start:             start,
+				evaluationSummary: newEvaluationSummary(),
+			})
+		}
+		res.Trend[len(res.Trend)-1].add(e.Evaluation)
+	}
+
+	if worst > 0 {
+		var rides []struct {
+			RideID      string    `db:"id"`
+			ChairID     string    `db:"chair_id"`
+			ChairName   string    `db:"name"`
+			Evaluation  int       `db:"evaluation"`
+			CompletedAt time.Time `db:"updated_at"`
+		}
+		if err := db.SelectContext(
+			ctx,
+			&rides,
+			`SELECT rides.id, rides.chair_id, chairs.name, rides.evaluation, rides.updated_at FROM rides JOIN chairs ON chairs.id = rides.chair_id
+			WHERE chairs.owner_id = ? AND rides.evaluation IS NOT NULL AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+			ORDER BY rides.evaluation ASC, rides.updated_at DESC LIMIT ?`,
+			owner.ID, since, until, worst,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, ride := range rides {
+			res.WorstRides = append(res.WorstRides, ownerGetEvaluationsResponseWorstRide{
+				RideID:      ride.RideID,
+				ChairID:     ride.ChairID,
+				ChairName:   ride.ChairName,
+				Evaluation:  ride.Evaluation,
+				CompletedAt: ride.CompletedAt.UnixMilli(),
+			})
+		}
+	}
+
+	alerts := []ChairRatingAlert{}
+	if err := db.SelectContext(ctx, &alerts, "SELECT * FROM chair_rating_alerts WHERE owner_id = ? AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND ORDER BY created_at DESC", owner.ID, since, until); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, alert := range alerts {
+		a := ownerRatingAlert{
+			ID:         alert.ID,
+			ChairID:    alert.ChairID,
+			Average:    alert.Average,
+			Threshold:  alert.Threshold,
+			WindowSize: alert.WindowSize,
+			CreatedAt:  alert.CreatedAt.UnixMilli(),
+		}
+		if alert.DeliveredAt != nil {
+			t := alert.DeliveredAt.UnixMilli()
+			a.DeliveredAt = &t
+		}
+		if alert.ResolvedAt != nil {
+			t := alert.ResolvedAt.UnixMilli()
+			a.ResolvedAt = &t
+		}
+		res.Alerts = append(res.Alerts, a)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerRatingAlertSetting struct {
+	Threshold  float64 `json:"threshold"`
+	WindowSize int     `json:"window_size"`
+	NotifyURL  *string `json:"notify_url"`
+}
+
+func ownerGetRatingAlertSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	setting, err := getOwnerRatingAlertSetting(ctx, db, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerRatingAlertSetting{
+		Threshold:  setting.Threshold,
+		WindowSize: setting.WindowSize,
+		NotifyURL:  setting.NotifyURL,
+	})
+}
+
+func ownerPutRatingAlertSetting(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerRatingAlertSetting{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Threshold < 1 || req.Threshold > 5 {
+		writeError(w, http.StatusBadRequest, errors.New("threshold must be between 1 and 5"))
+		return
+	}
+	if req.WindowSize < 1 || req.WindowSize > maxLowRatingWindowSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("window_size must be between 1 and %d", maxLowRatingWindowSize))
+		return
+	}
+	if req.NotifyURL != nil {
+		if *req.NotifyURL == "" {
+			req.NotifyURL = nil
+		} else if err := validateRatingAlertURL(ctx, *req.NotifyURL); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO owner_rating_alert_settings (owner_id, threshold, window_size, notify_url) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE threshold = VALUES(threshold), window_size = VALUES(window_size), notify_url = VALUES(notify_url)`,
+		owner.ID, req.Threshold, req.WindowSize, req.NotifyURL,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
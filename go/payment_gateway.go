@@ -21,7 +21,8 @@ type paymentGatewayGetPaymentsResponseOne struct {
 	Status string `json:"status"`
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+// countExpectedPayments には、この決済を含めて決済サービスに記録されているはずの決済数を返す関数を渡す
+func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, countExpectedPayments func() (int, error)) error {
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
@@ -47,34 +48,18 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 
 			if res.StatusCode != http.StatusNoContent {
 				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
+				payments, err := getPaymentGatewayPaymentCount(ctx, paymentGatewayURL, token)
 				if err != nil {
 					return err
 				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
 
-				getRes, err := http.DefaultClient.Do(getReq)
+				expected, err := countExpectedPayments()
 				if err != nil {
 					return err
 				}
-				defer res.Body.Close()
 
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
-
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
-
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
+				if expected != payments {
+					return fmt.Errorf("unexpected number of payments: %d != %d. %w", expected, payments, erroredUpstream)
 				}
 
 				return nil
@@ -95,3 +80,28 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 
 	return nil
 }
+
+// 決済サービスに記録されている、トークンの決済数を返す
+func getPaymentGatewayPaymentCount(ctx context.Context, paymentGatewayURL string, token string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("[GET /payments] unexpected status code (%d)", res.StatusCode)
+	}
+	var payments []paymentGatewayGetPaymentsResponseOne
+	if err := json.NewDecoder(res.Body).Decode(&payments); err != nil {
+		return 0, err
+	}
+	return len(payments), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const payoutCloseInterval = time.Minute
+
+func getPayoutPeriod(ctx context.Context, tx executableGet) (string, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'payout_period'"); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// now の直前に終わった締め期間。期間の区切りは UTC で、週は月曜始まり
+func lastPayoutPeriod(now time.Time, period string) (time.Time, time.Time) {
+	end := salesBucketStart(now, period, time.UTC)
+	start := salesBucketStart(end.Add(-time.Nanosecond), period, time.UTC)
+	return start, end
+}
+
+func payoutPeriodEnd(start time.Time, period string) time.Time {
+	switch period {
+	case "hour":
+		return start.Add(time.Hour)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// 締め済みの期間のライドが後から返金された場合は、その額を返金された期間の明細から差し引く。
+// 差し引くのは、ライドが完了したときに椅子を持っていたオーナーの明細から
+func getChairRefundAdjustment(ctx context.Context, tx *sqlx.Tx, period *ownedChairPeriod, start, end time.Time, platformFeePercent int) (int, error) {
+	completedBefore := start
+	if period.OwnedUntil != nil && period.OwnedUntil.Before(completedBefore) {
+		completedBefore = *period.OwnedUntil
+	}
+	var revenue int
+	if err := tx.GetContext(
+		ctx,
+		&revenue,
+		`SELECT IFNULL(SUM(ride_fares.base_fare + ride_fares.metered_fare + ride_fares.surcharge - IF(ride_fares.discount_funded_by = 'owner', ride_fares.discount, 0)), 0)
+		FROM rides
+			JOIN ride_payments ON ride_payments.ride_id = rides.id AND ride_payments.kind = 'fare'
+			JOIN ride_fares ON ride_fares.ride_id = rides.id
+		WHERE rides.chair_id = ? AND ride_payments.status = 'refunded' AND rides.updated_at >= ? AND rides.updated_at < ? AND ride_payments.updated_at >= ? AND ride_payments.updated_at < ?`,
+		period.ID, period.OwnedFrom, completedBefore, start, end,
+	); err != nil {
+		return 0, err
+	}
+	return applyPlatformFee(revenue, platformFeePercent), nil
+}
+
+// オーナーの [start, end) の明細を作る。既に締められていれば何もせず false を返す
+func closePayoutStatement(ctx context.Context, owner *Owner, start, end time.Time) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	statement := PayoutStatement{
+		ID:          ulid.Make().String(),
+		OwnerID:     owner.ID,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+	result, err := tx.ExecContext(
+		ctx,
+		`INSERT IGNORE INTO payout_statements (id, owner_id, period_start, period_end, rides, gross_fare, platform_discount, owner_discount, charged, refunds, platform_fee, net, refund_adjustment, tips, payout)
+		VALUES (?, ?, ?, ?, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)`,
+		statement.ID, statement.OwnerID, statement.PeriodStart, statement.PeriodEnd,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		return false, nil
+	}
+
+	platformFeePercent, err := getPlatformFeePercent(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+
+	periods, err := getOwnedChairPeriods(ctx, tx, owner.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// 移管された椅子は、このオーナーが持っていた期間の分だけを明細に入れる。
+	// 期間中に移管されて戻ってきた椅子は、それぞれの所有期間の分を1行にまとめる
+	items := map[string]*PayoutStatementItem{}
+	chairIDs := []string{}
+	for i := range periods {
+		period := &periods[i]
+		if !period.OwnedFrom.Before(end) || (period.OwnedUntil != nil && !period.OwnedUntil.After(start)) {
+			continue
+		}
+		// 締め日時ちょうどに完了したライドは次の期間に入る
+		from, to, _ := period.clip(start, end.Add(-time.Millisecond))
+		breakdown, err := getChairSalesBreakdown(ctx, tx, period.ID, from, to, platformFeePercent)
+		if err != nil {
+			return false, err
+		}
+		refundAdjustment, err := getChairRefundAdjustment(ctx, tx, period, start, end, platformFeePercent)
+		if err != nil {
+			return false, err
+		}
+		var tips int
+		if err := tx.GetContext(ctx, &tips, "SELECT IFNULL(SUM(ride_payments.amount), 0) FROM ride_payments JOIN rides ON rides.id = ride_payments.ride_id WHERE rides.chair_id = ? AND ride_payments.kind = 'tip' AND ride_payments.status = 'succeeded' AND ride_payments.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", period.ID, from, to); err != nil {
+			return false, err
+		}
+
+		item, ok := items[period.ID]
+		if !ok {
+			item = &PayoutStatementItem{
+				StatementID: statement.ID,
+				ChairID:     period.ID,
+				ChairName:   period.Name,
+				ChairModel:  period.Model,
+			}
+			items[period.ID] = item
+			chairIDs = append(chairIDs, period.ID)
+		}
+		item.add(breakdown)
+		item.RefundAdjustment += refundAdjustment
+		item.Tips += tips
+	}
+
+	for _, chairID := range chairIDs {
+		item := items[chairID]
+		item.Payout = item.Net - item.RefundAdjustment + item.Tips
+
+		if _, err := tx.NamedExecContext(
+			ctx,
+			`INSERT INTO payout_statement_items (statement_id, chair_id, chair_name, chair_model, rides, gross_fare, platform_discount, owner_discount, charged, refunds, platform_fee, net, refund_adjustment, tips, payout)
+			VALUES (:statement_id, :chair_id, :chair_name, :chair_model, :rides, :gross_fare, :platform_discount, :owner_discount, :charged, :refunds, :platform_fee, :net, :refund_adjustment, :tips, :payout)`,
+			item,
+		); err != nil {
+			return false, err
+		}
+
+		statement.add(item.salesBreakdown)
+		statement.RefundAdjustment += item.RefundAdjustment
+		statement.Tips += item.Tips
+		statement.Payout += item.Payout
+	}
+
+	if _, err := tx.NamedExecContext(
+		ctx,
+		`UPDATE payout_statements SET rides = :rides, gross_fare = :gross_fare, platform_discount = :platform_discount, owner_discount = :owner_discount,
+			charged = :charged, refunds = :refunds, platform_fee = :platform_fee, net = :net, refund_adjustment = :refund_adjustment, tips = :tips, payout = :payout
+		WHERE id = :id`,
+		statement,
+	); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 全オーナーについて [start, end) を締める。締めた明細の数を返す
+func closePayoutPeriod(ctx context.Context, start, end time.Time) (int, error) {
+	owners := []Owner{}
+	if err := db.SelectContext(ctx, &owners, "SELECT * FROM owners WHERE created_at < ? AND NOT EXISTS (SELECT 1 FROM payout_statements WHERE owner_id = owners.id AND period_start = ?)", end, start); err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for i := range owners {
+		ok, err := closePayoutStatement(ctx, &owners[i], start, end)
+		if err != nil {
+			return closed, err
+		}
+		if ok {
+			closed++
+		}
+	}
+	return closed, nil
+}
+
+// 直前の期間がまだ締められていなければ締める。複数台で動いていても明細は1つしかできない
+func closeDuePayouts() {
+	ctx := context.Background()
+
+	period, err := getPayoutPeriod(ctx, db)
+	if err != nil {
+		log.Printf("failed to get payout period: %v", err)
+		return
+	}
+
+	start, end := lastPayoutPeriod(time.Now(), period)
+	if _, err := closePayoutPeriod(ctx, start, end); err != nil {
+		log.Printf("failed to close payout period: %v", err)
+	}
+}
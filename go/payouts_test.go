@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastPayoutPeriod(t *testing.T) {
+	// 2024-12-05 は木曜日
+	now := time.Date(2024, 12, 5, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		period    string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{period: "hour", wantStart: time.Date(2024, 12, 5, 9, 0, 0, 0, time.UTC), wantEnd: time.Date(2024, 12, 5, 10, 0, 0, 0, time.UTC)},
+		{period: "day", wantStart: time.Date(2024, 12, 4, 0, 0, 0, 0, time.UTC), wantEnd: time.Date(2024, 12, 5, 0, 0, 0, 0, time.UTC)},
+		{period: "week", wantStart: time.Date(2024, 11, 25, 0, 0, 0, 0, time.UTC), wantEnd: time.Date(2024, 12, 2, 0, 0, 0, 0, time.UTC)},
+		{period: "month", wantStart: time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC), wantEnd: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			start, end := lastPayoutPeriod(now, tt.period)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("lastPayoutPeriod() = [%s, %s), want [%s, %s)", start, end, tt.wantStart, tt.wantEnd)
+			}
+			if got := payoutPeriodEnd(start, tt.period); !got.Equal(end) {
+				t.Errorf("payoutPeriodEnd() = %s, want %s", got, end)
+			}
+		})
+	}
+}
+
+func TestLastPayoutPeriodAtBoundary(t *testing.T) {
+	// 期間の始まりちょうどなら、その直前の期間を締める
+	now := time.Date(2024, 12, 2, 0, 0, 0, 0, time.UTC)
+	start, end := lastPayoutPeriod(now, "week")
+	if want := time.Date(2024, 11, 25, 0, 0, 0, 0, time.UTC); !start.Equal(want) || !end.Equal(now) {
+		t.Errorf("lastPayoutPeriod() = [%s, %s), want [%s, %s)", start, end, want, now)
+	}
+}
+
+func TestLastPayoutPeriodUsesUTC(t *testing.T) {
+	// JST では月曜日でも UTC ではまだ日曜日
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	now := time.Date(2024, 12, 2, 8, 0, 0, 0, jst)
+	start, end := lastPayoutPeriod(now, "week")
+	if want := time.Date(2024, 11, 18, 0, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("start = %s, want %s", start, want)
+	}
+	if want := time.Date(2024, 11, 25, 0, 0, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("end = %s, want %s", end, want)
+	}
+}
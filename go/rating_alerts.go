@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	defaultLowRatingThreshold  = 3.0
+	defaultLowRatingWindowSize = 20
+	maxLowRatingWindowSize     = 1000
+
+	ratingAlertDeliveryTimeout = 5 * time.Second
+)
+
+var errRatingAlertDestinationNotAllowed = errors.New("notify_url must not point to a loopback, link-local or private address")
+
+// 通知先はオーナーが自由に決められるので、内部のネットワークに向けたリクエストを送らないようにする。
+// 名前解決の結果が設定時と配送時で変わることもあるので、接続する直前のアドレスでも確かめる
+var ratingAlertClient = &http.Client{
+	Timeout: ratingAlertDeliveryTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: ratingAlertDeliveryTimeout,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return errRatingAlertDestinationNotAllowed
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: ratingAlertDeliveryTimeout,
+	},
+	// リダイレクト先で内部のアドレスに向けられないように、リダイレクトはたどらない
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// http か https の URL で、名前解決したアドレスがすべて外部のものであること
+func validateRatingAlertURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("notify_url must be an http or https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("failed to resolve the host of notify_url: %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errRatingAlertDestinationNotAllowed
+		}
+	}
+	return nil
+}
+
+// 設定が無いオーナーには既定値を使う
+func getOwnerRatingAlertSetting(ctx context.Context, tx executableGet, ownerID string) (*OwnerRatingAlertSetting, error) {
+	setting := &OwnerRatingAlertSetting{}
+	if err := tx.GetContext(ctx, setting, "SELECT * FROM owner_rating_alert_settings WHERE owner_id = ?", ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &OwnerRatingAlertSetting{
+				OwnerID:    ownerID,
+				Threshold:  defaultLowRatingThreshold,
+				WindowSize: defaultLowRatingWindowSize,
+			}, nil
+		}
+		return nil, err
+	}
+	return setting, nil
+}
+
+// 椅子の直近の評価の平均が閾値を下回ったら通知を記録し、戻ったら解消する。
+// 評価の件数が平均を取る件数に満たない間は判定しない
+func checkChairRatingAlert(ctx context.Context, chairID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	setting, err := getOwnerRatingAlertSetting(ctx, tx, chair.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	evaluations := []int{}
+	if err := tx.SelectContext(ctx, &evaluations, "SELECT evaluation FROM rides WHERE chair_id = ? AND evaluation IS NOT NULL ORDER BY updated_at DESC LIMIT ?", chair.ID, setting.WindowSize); err != nil {
+		return err
+	}
+	if len(evaluations) < setting.WindowSize {
+		return nil
+	}
+	total := 0
+	for _, e := range evaluations {
+		total += e
+	}
+	average := float64(total) / float64(len(evaluations))
+
+	open := []ChairRatingAlert{}
+	if err := tx.SelectContext(ctx, &open, "SELECT * FROM chair_rating_alerts WHERE chair_id = ? AND resolved_at IS NULL", chair.ID); err != nil {
+		return err
+	}
+
+	var alert *ChairRatingAlert
+	switch {
+	case average < setting.Threshold && len(open) == 0:
+		alert = &ChairRatingAlert{
+			ID:         ulid.Make().String(),
+			ChairID:    chair.ID,
+			OwnerID:    chair.OwnerID,
+			Average:    average,
+			Threshold:  setting.Threshold,
+			WindowSize: setting.WindowSize,
+			CreatedAt:  time.Now(),
+		}
+		if _, err := tx.NamedExecContext(
+			ctx,
+			"INSERT INTO chair_rating_alerts (id, chair_id, owner_id, average, threshold, window_size, created_at) VALUES (:id, :chair_id, :owner_id, :average, :threshold, :window_size, :created_at)",
+			alert,
+		); err != nil {
+			return err
+		}
+	case average >= setting.Threshold && len(open) > 0:
+		if _, err := tx.ExecContext(ctx, "UPDATE chair_rating_alerts SET resolved_at = CURRENT_TIMESTAMP(6) WHERE chair_id = ? AND resolved_at IS NULL", chair.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if alert != nil && setting.NotifyURL != nil {
+		go func() {
+			if err := deliverChairRatingAlert(*setting.NotifyURL, chair, alert); err != nil {
+				log.Printf("failed to deliver rating alert: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+type chairRatingAlertPayload struct {
+	ID         string  `json:"id"`
+	ChairID    string  `json:"chair_id"`
+	ChairName  string  `json:"chair_name"`
+	Average    float64 `json:"average"`
+	Threshold  float64 `json:"threshold"`
+	WindowSize int     `json:"window_size"`
+	CreatedAt  int64   `json:"created_at"`
+}
+
+// オーナーが設定した URL に通知を POST する。届いたら delivered_at を記録する
+func deliverChairRatingAlert(url string, chair *Chair, alert *ChairRatingAlert) error {
+	b, err := json.Marshal(&chairRatingAlertPayload{
+		ID:         alert.ID,
+		ChairID:    chair.ID,
+		ChairName:  chair.Name,
+		Average:    alert.Average,
+		Threshold:  alert.Threshold,
+		WindowSize: alert.WindowSize,
+		CreatedAt:  alert.CreatedAt.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ratingAlertDeliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := ratingAlertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code from rating alert destination: %d", res.StatusCode)
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE chair_rating_alerts SET delivered_at = CURRENT_TIMESTAMP(6) WHERE id = ?", alert.ID)
+	return err
+}
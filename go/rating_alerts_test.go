@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidateRatingAlertURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{url: "https://203.0.113.10/hook", valid: true},
+		{url: "http://[2001:db8::1]:8080/hook", valid: true},
+		{url: "ftp://203.0.113.10/hook", valid: false},
+		{url: "http://127.0.0.1/hook", valid: false},
+		{url: "http://[::1]/hook", valid: false},
+		{url: "http://10.1.2.3/hook", valid: false},
+		{url: "http://192.168.0.1/hook", valid: false},
+		{url: "http://169.254.169.254/latest/meta-data", valid: false},
+		{url: "http://0.0.0.0/hook", valid: false},
+		{url: "http:///hook", valid: false},
+	}
+	for _, tt := range tests {
+		err := validateRatingAlertURL(context.Background(), tt.url)
+		if tt.valid && err != nil {
+			t.Errorf("validateRatingAlertURL(%q) = %v, want nil", tt.url, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("validateRatingAlertURL(%q) = nil, want an error", tt.url)
+		}
+	}
+}
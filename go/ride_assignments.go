@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	rideAssignmentResultAccepted = "accepted"
+	rideAssignmentResultRejected = "rejected"
+	rideAssignmentResultTimeout  = "timeout"
+
+	rideAssignmentSweepInterval = time.Second
+
+	// 応答しなかった椅子は、この時間が経つか、ほかの椅子にこの回数割り当てられたらまた割り当てる
+	timedOutChairCooldown          = 30 * time.Second
+	timedOutChairExclusionAttempts = 3
+)
+
+// 割り当てられた椅子が ENROUTE を送ってくるまでの期限
+func getChairAckTimeout(ctx context.Context, tx executableGet) (time.Duration, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'chair_ack_timeout_seconds'"); err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// ライドを椅子に割り当て、その記録を残す
+func assignRide(ctx context.Context, tx *sqlx.Tx, rideID, chairID string, ackDeadline time.Time) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", chairID, rideID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO ride_assignments (id, ride_id, chair_id, ack_deadline) VALUES (?, ?, ?, ?)", ulid.Make().String(), rideID, chairID, ackDeadline)
+	return err
+}
+
+// まだ応答していない割り当てに椅子の応答を記録する
+func respondRideAssignment(ctx context.Context, tx *sqlx.Tx, rideID, chairID, result string, reason *string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"UPDATE ride_assignments SET result = ?, reason = ?, responded_at = CURRENT_TIMESTAMP(6) WHERE ride_id = ? AND chair_id = ? AND result IS NULL",
+		result, reason, rideID, chairID,
+	)
+	return err
+}
+
+// 同じライドに割り当てない椅子。断った椅子には二度と割り当てない。
+// 期限までに応答しなかった椅子は一時的に通信できなかっただけかもしれないので、しばらくしたらまた割り当てる
+func getExcludedChairIDs(ctx context.Context, rideID string) ([]string, error) {
+	chairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&chairIDs,
+		`SELECT DISTINCT chair_id FROM ride_assignments AS a
+		WHERE a.ride_id = ? AND (
+			a.result = ?
+			OR (
+				a.result = ? AND a.responded_at > ?
+				AND (SELECT COUNT(*) FROM ride_assignments AS later WHERE later.ride_id = a.ride_id AND later.assigned_at > a.assigned_at) < ?
+			)
+		)`,
+		rideID, rideAssignmentResultRejected, rideAssignmentResultTimeout, time.Now().Add(-timedOutChairCooldown), timedOutChairExclusionAttempts,
+	); err != nil {
+		return nil, err
+	}
+	return chairIDs, nil
+}
+
+// 完了していないライドが椅子に残っているか
+func chairHasActiveRide(ctx context.Context, tx executableGet, chairID string) (bool, error) {
+	var busy bool
+	if err := tx.GetContext(ctx, &busy, "SELECT EXISTS (SELECT 1 FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id WHERE rides.chair_id = ? AND latest_ride_statuses.status <> 'COMPLETED')", chairID); err != nil {
+		return false, err
+	}
+	return busy, nil
+}
+
+// 期限までに椅子が応答しなかった割り当てを取り消し、ライドを配車待ちに戻す
+func sweepUnacknowledgedAssignments() {
+	ctx := context.Background()
+
+	assignments := []RideAssignment{}
+	if err := db.SelectContext(
+		ctx,
+		&assignments,
+		"SELECT ride_assignments.* FROM ride_assignments JOIN rides ON rides.id = ride_assignments.ride_id AND rides.chair_id = ride_assignments.chair_id WHERE ride_assignments.result IS NULL AND ride_assignments.ack_deadline < ?",
+		time.Now(),
+	); err != nil {
+		log.Printf("failed to get unacknowledged ride assignments: %v", err)
+		return
+	}
+
+	for i := range assignments {
+		if err := expireRideAssignment(ctx, &assignments[i]); err != nil {
+			log.Printf("failed to expire ride assignment %s: %v", assignments[i].ID, err)
+		}
+	}
+}
+
+func expireRideAssignment(ctx context.Context, assignment *RideAssignment) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", assignment.RideID); err != nil {
+		return err
+	}
+	// 期限を過ぎた後で応答が届いていたら何もしない
+	if ride.ChairID.String != assignment.ChairID {
+		return nil
+	}
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		return err
+	}
+	if status != "MATCHING" {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL WHERE id = ?", ride.ID); err != nil {
+		return err
+	}
+	if err := respondRideAssignment(ctx, tx, ride.ID, assignment.ChairID, rideAssignmentResultTimeout, nil); err != nil {
+		return err
+	}
+	busy, err := chairHasActiveRide(ctx, tx, assignment.ChairID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	chairIndex.SetBusy(assignment.ChairID, busy)
+	if !busy {
+		if err := applyPendingChairDeactivation(ctx, assignment.ChairID); err != nil {
+			log.Printf("failed to apply pending chair deactivation: %v", err)
+		}
+	}
+
+	user := &User{}
+	if err := db.GetContext(ctx, user, "SELECT * FROM users WHERE id = ?", ride.UserID); err != nil {
+		return err
+	}
+	return notifyRideStatus(user)
+}
+
+// 期限切れで取り消された割り当てのうち、まだ椅子に伝えていないもの。伝えたものとして記録する
+func popExpiredRideAssignment(ctx context.Context, tx *sqlx.Tx, chairID string) (*RideAssignment, error) {
+	assignment := &RideAssignment{}
+	if err := tx.GetContext(
+		ctx,
+		assignment,
+		"SELECT * FROM ride_assignments WHERE chair_id = ? AND result = ? AND chair_notified_at IS NULL ORDER BY responded_at LIMIT 1 FOR UPDATE",
+		chairID, rideAssignmentResultTimeout,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE ride_assignments SET chair_notified_at = CURRENT_TIMESTAMP(6) WHERE id = ?", assignment.ID); err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
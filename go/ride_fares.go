@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	paymentKindFare = "fare"
+	paymentKindTip  = "tip"
+
+	paymentMethodToken = "payment_token"
+
+	paymentStatusSucceeded = "succeeded"
+	paymentStatusFailed    = "failed"
+	paymentStatusRefunded  = "refunded"
+)
+
+// 運賃の内訳を求める。割引は距離運賃を上限とする
+func calculateFareBreakdown(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, coupon *Coupon, campaign *Campaign) RideFare {
+	return calculateFareBreakdownForDistance(calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude), coupon, campaign)
+}
+
+func calculateFareBreakdownForDistance(distance int, coupon *Coupon, campaign *Campaign) RideFare {
+	meteredFare := farePerDistance * distance
+	discount := min(calculateCouponDiscount(coupon, campaign, meteredFare), meteredFare)
+
+	f := RideFare{
+		BaseFare:        initialFare,
+		Distance:        distance,
+		FarePerDistance: farePerDistance,
+		MeteredFare:     meteredFare,
+		Discount:        discount,
+		DistanceBasis:   fareDistanceBasisStraight,
+	}
+	if coupon != nil {
+		f.CouponCode = &coupon.Code
+		fundedBy := discountFundedByPlatform
+		if campaign != nil {
+			fundedBy = campaign.FundedBy
+		}
+		f.DiscountFundedBy = &fundedBy
+	}
+	f.Fare = f.BaseFare + f.MeteredFare - f.Discount + f.Surcharge
+	return f
+}
+
+func insertRideFare(ctx context.Context, tx *sqlx.Tx, fare *RideFare) error {
+	_, err := tx.NamedExecContext(
+		ctx,
+		`INSERT INTO ride_fares (ride_id, base_fare, distance, fare_per_distance, metered_fare, coupon_code, discount, discount_funded_by, surcharge, fare, distance_basis)
+		VALUES (:ride_id, :base_fare, :distance, :fare_per_distance, :metered_fare, :coupon_code, :discount, :discount_funded_by, :surcharge, :fare, :distance_basis)`,
+		fare,
+	)
+	return err
+}
+
+// ライド作成時に保存した運賃の内訳を返す。保存される前に作られたライドでは nil になる
+func getRideFare(ctx context.Context, tx executableGet, rideID string) (*RideFare, error) {
+	fare := &RideFare{}
+	if err := tx.GetContext(ctx, fare, "SELECT * FROM ride_fares WHERE ride_id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fare, nil
+}
+
+func getRidePayment(ctx context.Context, tx executableGet, rideID string, kind string) (*RidePayment, error) {
+	payment := &RidePayment{}
+	if err := tx.GetContext(ctx, payment, "SELECT * FROM ride_payments WHERE ride_id = ? AND kind = ?", rideID, kind); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// 決済の結果を記録する。成功した決済は、ライドの更新と一緒にコミットされるようにトランザクション内で記録する。
+// 失敗した決済はトランザクションがロールバックされても残るように recordFailedRidePayment で記録する
+func recordRidePayment(ctx context.Context, tx execer, rideID string, kind string, amount int, token string, status string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_payments (ride_id, kind, amount, payment_method, token_suffix, status) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE amount = VALUES(amount), token_suffix = VALUES(token_suffix), status = VALUES(status)`,
+		rideID, kind, amount, paymentMethodToken, tokenSuffix(token), status,
+	)
+	return err
+}
+
+// 決済の失敗をトランザクション外で記録する。行ロックを持ったままだと記録が待たされるので、先にロールバックしておく
+func recordFailedRidePayment(tx *sqlx.Tx, rideID string, kind string, amount int, token string) {
+	tx.Rollback()
+	if err := recordRidePayment(context.Background(), db, rideID, kind, amount, token, paymentStatusFailed); err != nil {
+		log.Printf("failed to record payment: %v", err)
+	}
+}
+
+func tokenSuffix(token string) string {
+	if len(token) <= 4 {
+		return token
+	}
+	return token[len(token)-4:]
+}
+
+type rideReceipt struct {
+	RideID                string              `json:"ride_id"`
+	Chair                 rideReceiptChair    `json:"chair"`
+	PickupCoordinate      Coordinate          `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate          `json:"destination_coordinate"`
+	RequestedAt           int64               `json:"requested_at"`
+	CompletedAt           int64               `json:"completed_at"`
+	BaseFare              int                 `json:"base_fare"`
+	Distance              int                 `json:"distance"`
+	DistanceBasis         string              `json:"distance_basis"`
+	FarePerDistance       int                 `json:"fare_per_distance"`
+	MeteredFare           int                 `json:"metered_fare"`
+	CouponCode            *string             `json:"coupon_code"`
+	Discount              int                 `json:"discount"`
+	Surcharge             int                 `json:"surcharge"`
+	Fare                  int                 `json:"fare"`
+	Payment               *rideReceiptPayment `json:"payment"`
+	Tip                   *rideReceiptPayment `json:"tip"`
+}
+
+type rideReceiptChair struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	Owner string `json:"owner"`
+}
+
+type rideReceiptPayment struct {
+	Method      string `json:"method"`
+	TokenSuffix string `json:"token_suffix"`
+	Amount      int    `json:"amount"`
+	Status      string `json:"status"`
+	PaidAt      int64  `json:"paid_at"`
+}
+
+func newRideReceiptPayment(payment *RidePayment) *rideReceiptPayment {
+	return &rideReceiptPayment{
+		Method:      payment.PaymentMethod,
+		TokenSuffix: payment.TokenSuffix,
+		Amount:      payment.Amount,
+		Status:      payment.Status,
+		PaidAt:      payment.UpdatedAt.UnixMilli(),
+	}
+}
+
+// 領収書をテキストで表現する
+func (r *rideReceipt) text() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "ISURIDE 領収書\n")
+	fmt.Fprintf(b, "ライドID: %s\n", r.RideID)
+	fmt.Fprintf(b, "椅子: %s (%s) / %s\n", r.Chair.Name, r.Chair.Model, r.Chair.Owner)
+	fmt.Fprintf(b, "配車位置: (%d, %d)\n", r.PickupCoordinate.Latitude, r.PickupCoordinate.Longitude)
+	fmt.Fprintf(b, "目的地: (%d, %d)\n", r.DestinationCoordinate.Latitude, r.DestinationCoordinate.Longitude)
+	fmt.Fprintf(b, "要求日時: %s\n", formatReceiptTime(r.RequestedAt))
+	fmt.Fprintf(b, "完了日時: %s\n", formatReceiptTime(r.CompletedAt))
+	fmt.Fprintf(b, "----------------------------------------\n")
+	fmt.Fprintf(b, "初乗り運賃: %d\n", r.BaseFare)
+	fmt.Fprintf(b, "距離運賃: %d (%d x %d)\n", r.MeteredFare, r.Distance, r.FarePerDistance)
+	if r.DistanceBasis == fareDistanceBasisMeasured {
+		fmt.Fprintf(b, "距離: 実際に移動した距離\n")
+	}
+	if r.CouponCode != nil {
+		fmt.Fprintf(b, "クーポン割引: -%d (%s)\n", r.Discount, *r.CouponCode)
+	}
+	if r.Surcharge != 0 {
+		fmt.Fprintf(b, "追加料金: %d\n", r.Surcharge)
+	}
+	fmt.Fprintf(b, "合計: %d\n", r.Fare)
+	fmt.Fprintf(b, "----------------------------------------\n")
+	if r.Payment != nil {
+		fmt.Fprintf(b, "支払い方法: %s (末尾 %s)\n", r.Payment.Method, r.Payment.TokenSuffix)
+		fmt.Fprintf(b, "支払い状況: %s\n", r.Payment.Status)
+	} else {
+		fmt.Fprintf(b, "支払い状況: 未払い\n")
+	}
+	if r.Tip != nil {
+		fmt.Fprintf(b, "チップ: %d (%s)\n", r.Tip.Amount, r.Tip.Status)
+	}
+	return b.String()
+}
+
+func formatReceiptTime(unixMilli int64) string {
+	return time.UnixMilli(unixMilli).Format("2006-01-02 15:04:05")
+}
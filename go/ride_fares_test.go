@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCalculateFareBreakdown(t *testing.T) {
+	cap300 := 300
+	tests := []struct {
+		name     string
+		distance int
+		coupon   *Coupon
+		campaign *Campaign
+		want     RideFare
+	}{
+		{
+			name:     "no coupon",
+			distance: 20,
+			want:     RideFare{BaseFare: 500, Distance: 20, FarePerDistance: 100, MeteredFare: 2000, Fare: 2500},
+		},
+		{
+			name:     "fixed discount",
+			distance: 20,
+			coupon:   &Coupon{Code: "CP_NEW2024", Discount: 1500},
+			campaign: &Campaign{DiscountType: discountTypeFixed, FundedBy: discountFundedByPlatform},
+			want:     RideFare{BaseFare: 500, Distance: 20, FarePerDistance: 100, MeteredFare: 2000, Discount: 1500, Fare: 1000},
+		},
+		{
+			// 割引は距離運賃までで、初乗り運賃は割り引かない
+			name:     "fixed discount larger than metered fare",
+			distance: 5,
+			coupon:   &Coupon{Code: "CP_NEW2024", Discount: 3000},
+			campaign: &Campaign{DiscountType: discountTypeFixed, FundedBy: discountFundedByPlatform},
+			want:     RideFare{BaseFare: 500, Distance: 5, FarePerDistance: 100, MeteredFare: 500, Discount: 500, Fare: 500},
+		},
+		{
+			name:     "percent discount",
+			distance: 20,
+			coupon:   &Coupon{Code: "PCT10"},
+			campaign: &Campaign{DiscountType: discountTypePercent, DiscountValue: 10, FundedBy: discountFundedByOwner},
+			want:     RideFare{BaseFare: 500, Distance: 20, FarePerDistance: 100, MeteredFare: 2000, Discount: 200, Fare: 2300},
+		},
+		{
+			name:     "percent discount with cap",
+			distance: 20,
+			coupon:   &Coupon{Code: "PCT50"},
+			campaign: &Campaign{DiscountType: discountTypePercent, DiscountValue: 50, DiscountCap: &cap300, FundedBy: discountFundedByPlatform},
+			want:     RideFare{BaseFare: 500, Distance: 20, FarePerDistance: 100, MeteredFare: 2000, Discount: 300, Fare: 2200},
+		},
+		{
+			// キャンペーンが消えたクーポンは定額の割引として扱い、運営が負担する
+			name:     "coupon without campaign",
+			distance: 20,
+			coupon:   &Coupon{Code: "OLD", Discount: 700},
+			want:     RideFare{BaseFare: 500, Distance: 20, FarePerDistance: 100, MeteredFare: 2000, Discount: 700, Fare: 1800},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateFareBreakdownForDistance(tt.distance, tt.coupon, tt.campaign)
+			if got.BaseFare != tt.want.BaseFare || got.Distance != tt.want.Distance || got.FarePerDistance != tt.want.FarePerDistance ||
+				got.MeteredFare != tt.want.MeteredFare || got.Discount != tt.want.Discount || got.Fare != tt.want.Fare {
+				t.Errorf("calculateFareBreakdownForDistance() = %+v, want %+v", got, tt.want)
+			}
+			if got.DistanceBasis != fareDistanceBasisStraight {
+				t.Errorf("distance_basis = %s, want %s", got.DistanceBasis, fareDistanceBasisStraight)
+			}
+			if tt.coupon == nil {
+				if got.CouponCode != nil || got.DiscountFundedBy != nil {
+					t.Errorf("coupon_code = %v, discount_funded_by = %v, want nil", got.CouponCode, got.DiscountFundedBy)
+				}
+				return
+			}
+			if got.CouponCode == nil || *got.CouponCode != tt.coupon.Code {
+				t.Errorf("coupon_code = %v, want %s", got.CouponCode, tt.coupon.Code)
+			}
+			wantFundedBy := discountFundedByPlatform
+			if tt.campaign != nil {
+				wantFundedBy = tt.campaign.FundedBy
+			}
+			if got.DiscountFundedBy == nil || *got.DiscountFundedBy != wantFundedBy {
+				t.Errorf("discount_funded_by = %v, want %s", got.DiscountFundedBy, wantFundedBy)
+			}
+		})
+	}
+}
+
+func TestCalculateFareBreakdownUsesStraightDistance(t *testing.T) {
+	got := calculateFareBreakdown(0, 0, 3, -4, nil, nil)
+	if got.Distance != 7 || got.Fare != calculateFare(0, 0, 3, -4) {
+		t.Errorf("distance = %d, fare = %d, want 7, %d", got.Distance, got.Fare, calculateFare(0, 0, 3, -4))
+	}
+}
+
+func TestTokenSuffix(t *testing.T) {
+	if got := tokenSuffix("34ea320039fc61ae2558176607a2e12c"); got != "e12c" {
+		t.Errorf("tokenSuffix() = %s, want e12c", got)
+	}
+	if got := tokenSuffix("abc"); got != "abc" {
+		t.Errorf("tokenSuffix() = %s, want abc", got)
+	}
+}
+
+func TestRideReceiptText(t *testing.T) {
+	code := "CP_NEW2024"
+	receipt := &rideReceipt{
+		RideID:          "01JDFEDF00B09BNMV8MP0RB34G",
+		Chair:           rideReceiptChair{Name: "QC-L13-8361", Model: "クエストチェア Lite", Owner: "匠椅子製作所"},
+		BaseFare:        500,
+		Distance:        20,
+		DistanceBasis:   fareDistanceBasisStraight,
+		FarePerDistance: 100,
+		MeteredFare:     2000,
+		CouponCode:      &code,
+		Discount:        1500,
+		Fare:            1000,
+		Payment:         &rideReceiptPayment{Method: paymentMethodToken, TokenSuffix: "e12c", Amount: 1000, Status: paymentStatusSucceeded},
+	}
+	text := receipt.text()
+	for _, want := range []string{receipt.RideID, "QC-L13-8361", code, "e12c"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("receipt text does not contain %q:\n%s", want, text)
+		}
+	}
+}
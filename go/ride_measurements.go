@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	fareDistanceBasisStraight = "straight"
+	fareDistanceBasisMeasured = "measured"
+)
+
+func getFareDistanceBasis(ctx context.Context, tx executableGet) (string, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'fare_distance_basis'"); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// 椅子が ENROUTE か CARRYING の間に移動した距離を、その区間の距離に足す
+func addRideMeasuredDistance(ctx context.Context, rideID string, status string, distance int) error {
+	query := "INSERT INTO ride_measurements (ride_id, enroute_distance) VALUES (?, ?) ON DUPLICATE KEY UPDATE enroute_distance = enroute_distance + VALUES(enroute_distance)"
+	if status == "CARRYING" {
+		query = "INSERT INTO ride_measurements (ride_id, carrying_distance) VALUES (?, ?) ON DUPLICATE KEY UPDATE carrying_distance = carrying_distance + VALUES(carrying_distance)"
+	}
+	_, err := db.ExecContext(ctx, query, rideID, distance)
+	return err
+}
+
+// 区間の始まりの状態になってから、区間の終わりの位置が報告された at までを区間の時間として記録する
+func finishRideMeasuredLeg(ctx context.Context, rideID string, status string, at time.Time) error {
+	var startedAt time.Time
+	if err := db.GetContext(ctx, &startedAt, "SELECT created_at FROM ride_statuses WHERE ride_id = ? AND status = ? ORDER BY created_at LIMIT 1", rideID, status); err != nil {
+		return err
+	}
+	duration := at.Sub(startedAt).Milliseconds()
+
+	query := "INSERT INTO ride_measurements (ride_id, enroute_duration) VALUES (?, ?) ON DUPLICATE KEY UPDATE enroute_duration = VALUES(enroute_duration)"
+	if status == "CARRYING" {
+		query = "INSERT INTO ride_measurements (ride_id, carrying_duration) VALUES (?, ?) ON DUPLICATE KEY UPDATE carrying_duration = VALUES(carrying_duration)"
+	}
+	_, err := db.ExecContext(ctx, query, rideID, duration)
+	return err
+}
+
+// 測定が始まる前のライドでは nil になる
+func getRideMeasurement(ctx context.Context, tx executableGet, rideID string) (*RideMeasurement, error) {
+	m := &RideMeasurement{}
+	if err := tx.GetContext(ctx, m, "SELECT * FROM ride_measurements WHERE ride_id = ?", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// 実測距離で運賃を求める設定のとき、ユーザーを乗せて移動した距離で運賃の内訳を求め直す。
+// 目的地に着くまで測れていないライドや、運賃の内訳が保存される前のライドはそのままにする
+func applyMeasuredFare(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	basis, err := getFareDistanceBasis(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if basis != fareDistanceBasisMeasured {
+		return nil
+	}
+
+	fare, err := getRideFare(ctx, tx, ride.ID)
+	if err != nil {
+		return err
+	}
+	measurement, err := getRideMeasurement(ctx, tx, ride.ID)
+	if err != nil {
+		return err
+	}
+	if fare == nil || measurement == nil || measurement.CarryingDuration == nil {
+		return nil
+	}
+
+	coupon, campaign, err := getRideCoupon(ctx, tx, ride.ID)
+	if err != nil {
+		return err
+	}
+	measured := calculateMeasuredFareBreakdown(fare, measurement.CarryingDistance, coupon, campaign)
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE ride_fares SET distance = ?, metered_fare = ?, discount = ?, fare = ?, distance_basis = ? WHERE ride_id = ?",
+		measured.Distance, measured.MeteredFare, measured.Discount, measured.Fare, fareDistanceBasisMeasured, ride.ID,
+	)
+	return err
+}
+
+// ユーザーを乗せて移動した距離で運賃の内訳を求め直す。割増運賃は保存されている内訳のものをそのまま使う
+func calculateMeasuredFareBreakdown(fare *RideFare, carryingDistance int, coupon *Coupon, campaign *Campaign) RideFare {
+	measured := calculateFareBreakdownForDistance(carryingDistance, coupon, campaign)
+	measured.RideID = fare.RideID
+	measured.Surcharge = fare.Surcharge
+	measured.Fare += fare.Surcharge
+	measured.DistanceBasis = fareDistanceBasisMeasured
+	return measured
+}
+
+// 測れている区間だけ値が入る
+type rideMeasurementResponse struct {
+	EnrouteDistance    int    `json:"enroute_distance"`
+	EnrouteDurationMs  *int64 `json:"enroute_duration_ms"`
+	CarryingDistance   int    `json:"carrying_distance"`
+	CarryingDurationMs *int64 `json:"carrying_duration_ms"`
+}
+
+func newRideMeasurementResponse(m *RideMeasurement) *rideMeasurementResponse {
+	if m == nil {
+		return nil
+	}
+	return &rideMeasurementResponse{
+		EnrouteDistance:    m.EnrouteDistance,
+		EnrouteDurationMs:  m.EnrouteDuration,
+		CarryingDistance:   m.CarryingDistance,
+		CarryingDurationMs: m.CarryingDuration,
+	}
+}
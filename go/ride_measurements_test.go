@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestCalculateMeasuredFareBreakdown(t *testing.T) {
+	code := "CP_NEW2024"
+	fundedBy := discountFundedByPlatform
+	// 直線距離 10 で作った運賃の内訳。割増運賃が付いている
+	fare := &RideFare{
+		RideID:           "01JDFEDF00B09BNMV8MP0RB34G",
+		BaseFare:         500,
+		Distance:         10,
+		FarePerDistance:  100,
+		MeteredFare:      1000,
+		CouponCode:       &code,
+		Discount:         1000,
+		DiscountFundedBy: &fundedBy,
+		Surcharge:        300,
+		Fare:             800,
+		DistanceBasis:    fareDistanceBasisStraight,
+	}
+	coupon := &Coupon{Code: code, Discount: 1500}
+	campaign := &Campaign{DiscountType: discountTypeFixed, FundedBy: discountFundedByPlatform}
+
+	tests := []struct {
+		name             string
+		carryingDistance int
+		coupon           *Coupon
+		want             RideFare
+	}{
+		{
+			name:             "measured distance longer than straight distance",
+			carryingDistance: 18,
+			coupon:           coupon,
+			want:             RideFare{Distance: 18, MeteredFare: 1800, Discount: 1500, Fare: 1100},
+		},
+		{
+			// 割引は実測の距離運賃までになる
+			name:             "discount capped by measured metered fare",
+			carryingDistance: 4,
+			coupon:           coupon,
+			want:             RideFare{Distance: 4, MeteredFare: 400, Discount: 400, Fare: 800},
+		},
+		{
+			name:             "no coupon",
+			carryingDistance: 12,
+			want:             RideFare{Distance: 12, MeteredFare: 1200, Fare: 2000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c *Campaign
+			if tt.coupon != nil {
+				c = campaign
+			}
+			got := calculateMeasuredFareBreakdown(fare, tt.carryingDistance, tt.coupon, c)
+			if got.Distance != tt.want.Distance || got.MeteredFare != tt.want.MeteredFare || got.Discount != tt.want.Discount || got.Fare != tt.want.Fare {
+				t.Errorf("calculateMeasuredFareBreakdown() = %+v, want %+v", got, tt.want)
+			}
+			if got.RideID != fare.RideID || got.Surcharge != fare.Surcharge {
+				t.Errorf("ride_id = %s, surcharge = %d, want %s, %d", got.RideID, got.Surcharge, fare.RideID, fare.Surcharge)
+			}
+			if got.DistanceBasis != fareDistanceBasisMeasured {
+				t.Errorf("distance_basis = %s, want %s", got.DistanceBasis, fareDistanceBasisMeasured)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	discountFundedByPlatform = "platform"
+	discountFundedByOwner    = "owner"
+)
+
+// 実際に決済された金額から求めた売上の内訳
+type salesBreakdown struct {
+	Rides            int `db:"rides" json:"rides"`
+	GrossFare        int `db:"gross_fare" json:"gross_fare"`
+	PlatformDiscount int `db:"platform_discount" json:"platform_discount"`
+	OwnerDiscount    int `db:"owner_discount" json:"owner_discount"`
+	Charged          int `db:"charged" json:"charged"`
+	Refunds          int `db:"refunds" json:"refunds"`
+	PlatformFee      int `db:"platform_fee" json:"platform_fee"`
+	Net              int `db:"net" json:"net"`
+}
+
+func (s *salesBreakdown) add(o salesBreakdown) {
+	s.Rides += o.Rides
+	s.GrossFare += o.GrossFare
+	s.PlatformDiscount += o.PlatformDiscount
+	s.OwnerDiscount += o.OwnerDiscount
+	s.Charged += o.Charged
+	s.Refunds += o.Refunds
+	s.PlatformFee += o.PlatformFee
+	s.Net += o.Net
+}
+
+func getPlatformFeePercent(ctx context.Context, tx *sqlx.Tx) (int, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'platform_fee_percent'"); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// 椅子の売上を、完了したライドについて保存された運賃の内訳から集計する。
+// 運賃の内訳や決済の記録が無い古いライドは、割引の無い直線距離の運賃で決済されたものとして数え、決済に失敗したライドは含めない。
+// プラットフォーム負担の割引はオーナーの売上から引かず、返金されたライドは売上に含めない
+func getChairSalesBreakdown(ctx context.Context, tx *sqlx.Tx, chairID string, since, until time.Time, platformFeePercent int) (salesBreakdown, error) {
+	s := salesBreakdown{}
+	if err := tx.GetContext(
+		ctx,
+		&s,
+		`SELECT
+			COUNT(*) AS rides,
+			IFNULL(SUM(`+rideGrossFareSQL+`), 0) AS gross_fare,
+			IFNULL(SUM(IF(ride_fares.discount_funded_by = 'owner', 0, IFNULL(ride_fares.discount, 0))), 0) AS platform_discount,
+			IFNULL(SUM(IF(ride_fares.discount_funded_by = 'owner', ride_fares.discount, 0)), 0) AS owner_discount,
+			IFNULL(SUM(CASE WHEN ride_payments.ride_id IS NULL THEN `+rideGrossFareSQL+` WHEN ride_payments.status = 'succeeded' THEN ride_payments.amount ELSE 0 END), 0) AS charged,
+			IFNULL(SUM(IF(ride_payments.status = 'refunded', `+rideGrossFareSQL+` - IF(ride_fares.discount_funded_by = 'owner', ride_fares.discount, 0), 0)), 0) AS refunds,
+			0 AS platform_fee,
+			0 AS net
+		FROM rides
+			JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id
+			LEFT JOIN ride_payments ON ride_payments.ride_id = rides.id AND ride_payments.kind = 'fare'
+			LEFT JOIN ride_fares ON ride_fares.ride_id = rides.id
+		WHERE rides.chair_id = ? AND latest_ride_statuses.status = 'COMPLETED'
+			AND (ride_payments.ride_id IS NULL OR ride_payments.status IN ('succeeded', 'refunded'))
+			AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND`,
+		initialFare, farePerDistance, initialFare, farePerDistance, initialFare, farePerDistance,
+		chairID, since, until,
+	); err != nil {
+		return s, err
+	}
+
+	revenue := s.GrossFare - s.OwnerDiscount - s.Refunds
+	s.PlatformFee = revenue * platformFeePercent / 100
+	s.Net = revenue - s.PlatformFee
+	return s, nil
+}
+
+// 割引前の運賃。運賃の内訳が保存される前のライドは直線距離から求める。初乗り運賃と距離あたりの運賃を順に渡すこと
+const rideGrossFareSQL = `IFNULL(ride_fares.base_fare + ride_fares.metered_fare + ride_fares.surcharge,
+				? + ? * (ABS(rides.pickup_latitude - rides.destination_latitude) + ABS(rides.pickup_longitude - rides.destination_longitude)))`
+
+// オーナーの取り分の元になる額。プラットフォームの手数料を引く前の値
+func rideOwnerRevenue(fare *RideFare) int {
+	revenue := fare.BaseFare + fare.MeteredFare + fare.Surcharge
+	if fare.DiscountFundedBy != nil && *fare.DiscountFundedBy == discountFundedByOwner {
+		revenue -= fare.Discount
+	}
+	return revenue
+}
+
+func applyPlatformFee(revenue int, platformFeePercent int) int {
+	return revenue - revenue*platformFeePercent/100
+}
+
+// 時系列レポートのために、ライドの完了日時を含む1時間ごとの集計に売上と評価を積み上げる。
+// 手数料率は後から変わりうるので、手数料を引く前の額で持っておく
+func addRideToHourlySales(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	revenue, err := getRideOwnerRevenue(ctx, tx, ride)
+	if err != nil {
+		return err
+	}
+
+	evaluationTotal, evaluationCount := 0, 0
+	if ride.Evaluation != nil {
+		evaluationTotal, evaluationCount = *ride.Evaluation, 1
+	}
+
+	bucketStart := ride.UpdatedAt.Truncate(time.Hour)
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, bucket_start, rides, revenue, evaluation_total, evaluation_count) VALUES (?, ?, 1, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE rides = rides + 1, revenue = revenue + VALUES(revenue), evaluation_total = evaluation_total + VALUES(evaluation_total), evaluation_count = evaluation_count + VALUES(evaluation_count)`,
+		ride.ChairID.String, bucketStart, revenue, evaluationTotal, evaluationCount,
+	); err != nil {
+		return err
+	}
+
+	// ライドの updated_at は後から変わりうるので、返金のときに同じ集計期間から取り除けるよう計上先を決済に残しておく
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE ride_payments SET sales_bucket_start = ?, updated_at = updated_at WHERE ride_id = ? AND kind = ?",
+		bucketStart, ride.ID, paymentKindFare,
+	)
+	return err
+}
+
+// 返金されたライドを、売上を計上した集計期間から取り除く。評価は返金と関係なく残す
+func removeRefundFromHourlySales(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	payment, err := getRidePayment(ctx, tx, ride.ID, paymentKindFare)
+	if err != nil {
+		return err
+	}
+	if payment == nil || payment.SalesBucketStart == nil {
+		return nil
+	}
+	revenue, err := getRideOwnerRevenue(ctx, tx, ride)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE chair_sales_hourly SET rides = rides - 1, revenue = revenue - ? WHERE chair_id = ? AND bucket_start = ?",
+		revenue, ride.ChairID.String, *payment.SalesBucketStart,
+	)
+	return err
+}
+
+// 手数料を引く前のオーナーの取り分。運賃の内訳が保存される前のライドは、割引の無い直線距離の運賃とする
+func getRideOwnerRevenue(ctx context.Context, tx *sqlx.Tx, ride *Ride) (int, error) {
+	fare, err := getRideFare(ctx, tx, ride.ID)
+	if err != nil {
+		return 0, err
+	}
+	if fare == nil {
+		return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), nil
+	}
+	return rideOwnerRevenue(fare), nil
+}
+
+// 完了したライドから1時間ごとの集計を作り直す。決済に失敗したライドは含めず、返金されたライドは評価だけ数える
+func rebuildHourlySales(ctx context.Context) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_sales_hourly"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_sales_hourly (chair_id, bucket_start, rides, revenue, evaluation_total, evaluation_count)
+		SELECT
+			rides.chair_id,
+			DATE_FORMAT(rides.updated_at, '%Y-%m-%d %H:00:00') AS bucket,
+			SUM(IF(ride_payments.status = 'refunded', 0, 1)),
+			IFNULL(SUM(IF(ride_payments.status = 'refunded', 0, `+rideGrossFareSQL+` - IF(ride_fares.discount_funded_by = 'owner', ride_fares.discount, 0))), 0),
+			IFNULL(SUM(rides.evaluation), 0),
+			COUNT(rides.evaluation)
+		FROM rides
+			JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id
+			LEFT JOIN ride_payments ON ride_payments.ride_id = rides.id AND ride_payments.kind = 'fare'
+			LEFT JOIN ride_fares ON ride_fares.ride_id = rides.id
+		WHERE latest_ride_statuses.status = 'COMPLETED' AND (ride_payments.ride_id IS NULL OR ride_payments.status IN ('succeeded', 'refunded'))
+		GROUP BY rides.chair_id, bucket`,
+		initialFare, farePerDistance,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE ride_payments JOIN rides ON rides.id = ride_payments.ride_id
+		SET ride_payments.sales_bucket_start = DATE_FORMAT(rides.updated_at, '%Y-%m-%d %H:00:00'), ride_payments.updated_at = ride_payments.updated_at
+		WHERE ride_payments.kind = 'fare' AND ride_payments.status IN ('succeeded', 'refunded')`,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// タイムゾーン loc での、t を含むバケットの開始日時。週は月曜始まり
+func salesBucketStart(t time.Time, granularity string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch granularity {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSalesBucketStart(t *testing.T) {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	// JST では 2024-12-02 (月) 08:30
+	at := time.Date(2024, 12, 1, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		granularity string
+		loc         *time.Location
+		want        time.Time
+	}{
+		{granularity: "hour", loc: time.UTC, want: time.Date(2024, 12, 1, 23, 0, 0, 0, time.UTC)},
+		{granularity: "day", loc: time.UTC, want: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{granularity: "day", loc: jst, want: time.Date(2024, 12, 2, 0, 0, 0, 0, jst)},
+		{granularity: "week", loc: time.UTC, want: time.Date(2024, 11, 25, 0, 0, 0, 0, time.UTC)},
+		{granularity: "week", loc: jst, want: time.Date(2024, 12, 2, 0, 0, 0, 0, jst)},
+		{granularity: "month", loc: time.UTC, want: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{granularity: "month", loc: jst, want: time.Date(2024, 12, 1, 0, 0, 0, 0, jst)},
+	}
+	for _, tt := range tests {
+		if got := salesBucketStart(at, tt.granularity, tt.loc); !got.Equal(tt.want) {
+			t.Errorf("salesBucketStart(%s, %s) = %s, want %s", tt.granularity, tt.loc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	serviceAreaShapeRectangle = "rectangle"
+	serviceAreaShapePolygon   = "polygon"
+)
+
+var (
+	errSamePickupAndDestination    = errors.New("pickup and destination must be different")
+	errPickupOutOfServiceArea      = errors.New("pickup coordinate is outside the service area")
+	errDestinationOutOfServiceArea = errors.New("destination coordinate is outside the service area")
+)
+
+type serviceArea struct {
+	ID       string
+	Name     string
+	Shape    string
+	Vertices []Coordinate
+}
+
+// 境界上の点はエリア内とみなす
+func (a *serviceArea) contains(c Coordinate) bool {
+	if a.Shape == serviceAreaShapeRectangle {
+		p, q := a.Vertices[0], a.Vertices[1]
+		return c.Latitude >= min(p.Latitude, q.Latitude) && c.Latitude <= max(p.Latitude, q.Latitude) &&
+			c.Longitude >= min(p.Longitude, q.Longitude) && c.Longitude <= max(p.Longitude, q.Longitude)
+	}
+
+	inside := false
+	for i := range a.Vertices {
+		p, q := a.Vertices[i], a.Vertices[(i+1)%len(a.Vertices)]
+		if onSegment(p, q, c) {
+			return true
+		}
+		// c から longitude の正の向きに伸ばした半直線が辺と交わる回数の偶奇で判定する
+		if (p.Latitude > c.Latitude) != (q.Latitude > c.Latitude) {
+			cross := (q.Longitude-p.Longitude)*(c.Latitude-p.Latitude) - (c.Longitude-p.Longitude)*(q.Latitude-p.Latitude)
+			if (cross > 0) == (q.Latitude > p.Latitude) {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func onSegment(p, q, c Coordinate) bool {
+	if (q.Latitude-p.Latitude)*(c.Longitude-p.Longitude) != (q.Longitude-p.Longitude)*(c.Latitude-p.Latitude) {
+		return false
+	}
+	return c.Latitude >= min(p.Latitude, q.Latitude) && c.Latitude <= max(p.Latitude, q.Latitude) &&
+		c.Longitude >= min(p.Longitude, q.Longitude) && c.Longitude <= max(p.Longitude, q.Longitude)
+}
+
+func parseServiceArea(a *ServiceArea) (*serviceArea, error) {
+	area := &serviceArea{ID: a.ID, Name: a.Name, Shape: a.Shape}
+	if err := json.Unmarshal([]byte(a.Vertices), &area.Vertices); err != nil {
+		return nil, err
+	}
+	if err := validateServiceAreaShape(area.Shape, area.Vertices); err != nil {
+		return nil, err
+	}
+	return area, nil
+}
+
+func validateServiceAreaShape(shape string, vertices []Coordinate) error {
+	switch shape {
+	case serviceAreaShapeRectangle:
+		if len(vertices) != 2 {
+			return errors.New("rectangle must have exactly 2 vertices")
+		}
+	case serviceAreaShapePolygon:
+		if len(vertices) < 3 {
+			return errors.New("polygon must have at least 3 vertices")
+		}
+	default:
+		return fmt.Errorf("invalid shape: %s", shape)
+	}
+	return nil
+}
+
+// サービスエリアと椅子ごとの営業エリアを DB と同じ内容でメモリ上に持つ
+var (
+	serviceAreasMutex sync.RWMutex
+	serviceAreas      = []*serviceArea{}
+	chairServiceAreas = map[string][]*serviceArea{}
+)
+
+func InitServiceAreas(db *sqlx.DB) error {
+	rows := []ServiceArea{}
+	if err := db.Select(&rows, "SELECT * FROM service_areas ORDER BY created_at"); err != nil {
+		return err
+	}
+	areas := make([]*serviceArea, 0, len(rows))
+	byID := make(map[string]*serviceArea, len(rows))
+	for i := range rows {
+		area, err := parseServiceArea(&rows[i])
+		if err != nil {
+			return fmt.Errorf("invalid service area %s: %w", rows[i].ID, err)
+		}
+		areas = append(areas, area)
+		byID[area.ID] = area
+	}
+
+	var zones []struct {
+		ChairID       string `db:"chair_id"`
+		ServiceAreaID string `db:"service_area_id"`
+	}
+	if err := db.Select(&zones, "SELECT chair_id, service_area_id FROM chair_service_areas"); err != nil {
+		return err
+	}
+	chairAreas := map[string][]*serviceArea{}
+	for _, z := range zones {
+		if area, ok := byID[z.ServiceAreaID]; ok {
+			chairAreas[z.ChairID] = append(chairAreas[z.ChairID], area)
+		}
+	}
+
+	violations := []string{}
+	if err := db.Select(&violations, "SELECT chair_id FROM chair_area_violations WHERE ended_at IS NULL"); err != nil {
+		return err
+	}
+	outside := make(map[string]bool, len(violations))
+	for _, chairID := range violations {
+		outside[chairID] = true
+	}
+
+	serviceAreasMutex.Lock()
+	serviceAreas = areas
+	chairServiceAreas = chairAreas
+	serviceAreasMutex.Unlock()
+
+	chairsOutsideAreaMutex.Lock()
+	chairsOutsideArea = outside
+	chairsOutsideAreaMutex.Unlock()
+	return nil
+}
+
+// サービスエリアが1つも無ければどこでも受け付ける
+func inServiceArea(c Coordinate) bool {
+	serviceAreasMutex.RLock()
+	defer serviceAreasMutex.RUnlock()
+
+	return containedByAny(serviceAreas, c)
+}
+
+// 営業エリアが決められている椅子はその中だけ、そうでなければサービスエリア内ならどこでも営業できる
+func chairCanServe(chairID string, c Coordinate) bool {
+	serviceAreasMutex.RLock()
+	defer serviceAreasMutex.RUnlock()
+
+	if areas, ok := chairServiceAreas[chairID]; ok {
+		return containedByAny(areas, c)
+	}
+	return containedByAny(serviceAreas, c)
+}
+
+func getChairServiceAreaIDs(chairID string) []string {
+	serviceAreasMutex.RLock()
+	defer serviceAreasMutex.RUnlock()
+
+	ids := []string{}
+	for _, area := range chairServiceAreas[chairID] {
+		ids = append(ids, area.ID)
+	}
+	return ids
+}
+
+func containedByAny(areas []*serviceArea, c Coordinate) bool {
+	if len(areas) == 0 {
+		return true
+	}
+	for _, area := range areas {
+		if area.contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRideCoordinates(pickup, destination Coordinate) error {
+	if pickup == destination {
+		return errSamePickupAndDestination
+	}
+	if !inServiceArea(pickup) {
+		return errPickupOutOfServiceArea
+	}
+	if !inServiceArea(destination) {
+		return errDestinationOutOfServiceArea
+	}
+	return nil
+}
+
+// 営業エリアの外から位置を報告している椅子
+var (
+	chairsOutsideAreaMutex sync.Mutex
+	chairsOutsideArea      = map[string]bool{}
+)
+
+func isChairOutsideArea(chairID string) bool {
+	chairsOutsideAreaMutex.Lock()
+	defer chairsOutsideAreaMutex.Unlock()
+
+	return chairsOutsideArea[chairID]
+}
+
+// 椅子が営業エリアの外に出たときと戻ったときに記録する。
+// 位置の報告ごとに呼ばれるので、ロックは出入りを判定する間だけ持ち、記録はロックを外してから行う
+func checkChairArea(ctx context.Context, chairID string, c Coordinate, at time.Time) error {
+	outside := !chairCanServe(chairID, c)
+
+	chairsOutsideAreaMutex.Lock()
+	if chairsOutsideArea[chairID] == outside {
+		chairsOutsideAreaMutex.Unlock()
+		return nil
+	}
+	if outside {
+		chairsOutsideArea[chairID] = true
+	} else {
+		delete(chairsOutsideArea, chairID)
+	}
+	chairsOutsideAreaMutex.Unlock()
+
+	var err error
+	if outside {
+		_, err = db.ExecContext(
+			ctx,
+			"INSERT INTO chair_area_violations (id, chair_id, latitude, longitude, started_at) VALUES (?, ?, ?, ?, ?)",
+			ulid.Make().String(), chairID, c.Latitude, c.Longitude, at,
+		)
+	} else {
+		_, err = db.ExecContext(ctx, "UPDATE chair_area_violations SET ended_at = ? WHERE chair_id = ? AND ended_at IS NULL", at, chairID)
+	}
+	if err != nil {
+		// 記録できなかったときは、次の報告でもう一度記録するように元に戻す。その間に別の報告で変わっていたらそちらに任せる
+		chairsOutsideAreaMutex.Lock()
+		if chairsOutsideArea[chairID] == outside {
+			if outside {
+				delete(chairsOutsideArea, chairID)
+			} else {
+				chairsOutsideArea[chairID] = true
+			}
+		}
+		chairsOutsideAreaMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+type serviceAreaResponse struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Shape     string       `json:"shape"`
+	Vertices  []Coordinate `json:"vertices"`
+	CreatedAt int64        `json:"created_at"`
+}
+
+func getServiceAreaResponses(ctx context.Context) ([]serviceAreaResponse, error) {
+	areas := []ServiceArea{}
+	if err := db.SelectContext(ctx, &areas, "SELECT * FROM service_areas ORDER BY created_at"); err != nil {
+		return nil, err
+	}
+	res := make([]serviceAreaResponse, 0, len(areas))
+	for _, a := range areas {
+		item := serviceAreaResponse{
+			ID:        a.ID,
+			Name:      a.Name,
+			Shape:     a.Shape,
+			CreatedAt: a.CreatedAt.UnixMilli(),
+		}
+		if err := json.Unmarshal([]byte(a.Vertices), &item.Vertices); err != nil {
+			return nil, err
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
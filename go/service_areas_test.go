@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestServiceAreaContains(t *testing.T) {
+	rectangle := &serviceArea{
+		Shape: serviceAreaShapeRectangle,
+		// 対角の2点はどちらの順でもよい
+		Vertices: []Coordinate{{Latitude: 10, Longitude: -10}, {Latitude: -10, Longitude: 10}},
+	}
+	// 左側が (5,5) まで凹んだ多角形。縦が latitude、横が longitude
+	//   (10,0) -- (10,10)
+	//      \      |
+	//     (5,5)   |
+	//      /      |
+	//   (0,0) -- (0,10)
+	concave := &serviceArea{
+		Shape: serviceAreaShapePolygon,
+		Vertices: []Coordinate{
+			{Latitude: 0, Longitude: 0},
+			{Latitude: 0, Longitude: 10},
+			{Latitude: 10, Longitude: 10},
+			{Latitude: 10, Longitude: 0},
+			{Latitude: 5, Longitude: 5},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		area  *serviceArea
+		point Coordinate
+		want  bool
+	}{
+		{name: "rectangle inside", area: rectangle, point: Coordinate{Latitude: 3, Longitude: -4}, want: true},
+		{name: "rectangle corner", area: rectangle, point: Coordinate{Latitude: -10, Longitude: -10}, want: true},
+		{name: "rectangle edge", area: rectangle, point: Coordinate{Latitude: 10, Longitude: 0}, want: true},
+		{name: "rectangle outside", area: rectangle, point: Coordinate{Latitude: 11, Longitude: 0}, want: false},
+		{name: "polygon inside", area: concave, point: Coordinate{Latitude: 2, Longitude: 8}, want: true},
+		{name: "polygon vertex", area: concave, point: Coordinate{Latitude: 10, Longitude: 10}, want: true},
+		{name: "polygon edge", area: concave, point: Coordinate{Latitude: 0, Longitude: 5}, want: true},
+		{name: "polygon slanted edge", area: concave, point: Coordinate{Latitude: 7, Longitude: 3}, want: true},
+		{name: "polygon reflex vertex", area: concave, point: Coordinate{Latitude: 5, Longitude: 5}, want: true},
+		{name: "polygon notch", area: concave, point: Coordinate{Latitude: 5, Longitude: 2}, want: false},
+		{name: "polygon outside", area: concave, point: Coordinate{Latitude: 5, Longitude: 11}, want: false},
+		// 半直線が頂点を通る場合も数え間違えない
+		{name: "polygon ray through vertex", area: concave, point: Coordinate{Latitude: 10, Longitude: -1}, want: false},
+		{name: "polygon below", area: concave, point: Coordinate{Latitude: -1, Longitude: 5}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.area.contains(tt.point); got != tt.want {
+				t.Errorf("contains(%+v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateServiceAreaShape(t *testing.T) {
+	tests := []struct {
+		shape    string
+		vertices int
+		valid    bool
+	}{
+		{shape: serviceAreaShapeRectangle, vertices: 2, valid: true},
+		{shape: serviceAreaShapeRectangle, vertices: 3, valid: false},
+		{shape: serviceAreaShapePolygon, vertices: 3, valid: true},
+		{shape: serviceAreaShapePolygon, vertices: 2, valid: false},
+		{shape: "circle", vertices: 3, valid: false},
+	}
+	for _, tt := range tests {
+		err := validateServiceAreaShape(tt.shape, make([]Coordinate, tt.vertices))
+		if tt.valid && err != nil {
+			t.Errorf("validateServiceAreaShape(%s, %d vertices) = %v, want nil", tt.shape, tt.vertices, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("validateServiceAreaShape(%s, %d vertices) = nil, want an error", tt.shape, tt.vertices)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	maxTipAmount = 10000
+	// ライド完了からチップを送れる期間
+	tipWindow = 24 * time.Hour
+)
+
+var (
+	errTipAlreadyPaid            = errors.New("tip already paid")
+	errPaymentTokenNotRegistered = errors.New("payment token not registered")
+)
+
+// 決済サービスに記録されているはずの決済数。完了したライドの運賃と、成功したチップの分
+func countExpectedPayments(ctx context.Context, tx *sqlx.Tx, userID string, pending int) (int, error) {
+	var count int
+	if err := tx.GetContext(
+		ctx,
+		&count,
+		`SELECT
+			(SELECT COUNT(*) FROM rides JOIN latest_ride_statuses ON latest_ride_statuses.ride_id = rides.id WHERE rides.user_id = ? AND latest_ride_statuses.status = 'COMPLETED') +
+			(SELECT COUNT(*) FROM ride_payments JOIN rides ON rides.id = ride_payments.ride_id WHERE rides.user_id = ? AND ride_payments.kind = 'tip' AND ride_payments.status = 'succeeded')`,
+		userID, userID,
+	); err != nil {
+		return 0, err
+	}
+	return count + pending, nil
+}
+
+// 決済サービスの決済数が、このチップを含めた数と一致すればチップは受け付けられている
+func confirmTipAccepted(ctx context.Context, tx *sqlx.Tx, paymentGatewayURL string, token string, userID string) (bool, error) {
+	payments, err := getPaymentGatewayPaymentCount(ctx, paymentGatewayURL, token)
+	if err != nil {
+		return false, err
+	}
+	expected, err := countExpectedPayments(ctx, tx, userID, 1)
+	if err != nil {
+		return false, err
+	}
+	return payments == expected, nil
+}
+
+// ライドが完了した日時。チップを送れる期間はここから数える
+func getRideCompletedAt(ctx context.Context, tx executableGet, rideID string) (time.Time, error) {
+	var completedAt time.Time
+	if err := tx.GetContext(ctx, &completedAt, "SELECT created_at FROM ride_statuses WHERE ride_id = ? AND status = 'COMPLETED' ORDER BY created_at LIMIT 1", rideID); err != nil {
+		return completedAt, err
+	}
+	return completedAt, nil
+}
+
+// 運賃とは別の決済としてチップを請求する
+func chargeTip(ctx context.Context, ride *Ride, amount int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tip := &RidePayment{}
+	if err := tx.GetContext(ctx, tip, "SELECT * FROM ride_payments WHERE ride_id = ? AND kind = ? FOR UPDATE", ride.ID, paymentKindTip); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	} else if tip.Status == paymentStatusSucceeded {
+		return errTipAlreadyPaid
+	}
+
+	paymentToken := &PaymentToken{}
+	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errPaymentTokenNotRegistered
+		}
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, &paymentGatewayPostPaymentRequest{Amount: amount}, func() (int, error) {
+		return countExpectedPayments(ctx, tx, ride.UserID, 1)
+	}); err != nil {
+		// 失敗と記録したチップが決済サービスに残っていると、以降の決済数の確認がすべて合わなくなるので、
+		// 失敗として記録する前に、このチップが受け付けられていないか決済数を確かめる
+		accepted, confirmErr := confirmTipAccepted(ctx, tx, paymentGatewayURL, paymentToken.Token, ride.UserID)
+		if confirmErr != nil {
+			log.Printf("failed to confirm tip payment: %v", confirmErr)
+		}
+		if !accepted {
+			recordFailedRidePayment(tx, ride.ID, paymentKindTip, amount, paymentToken.Token)
+			return err
+		}
+	}
+
+	if err := recordRidePayment(ctx, tx, ride.ID, paymentKindTip, amount, paymentToken.Token, paymentStatusSucceeded); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -38,6 +38,130 @@ CREATE TABLE chairs
 )
   COMMENT = '椅子情報テーブル';
 
+DROP TABLE IF EXISTS chair_retirements;
+CREATE TABLE chair_retirements
+(
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '引退日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '引退した椅子のテーブル';
+
+DROP TABLE IF EXISTS chair_ownerships;
+CREATE TABLE chair_ownerships
+(
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id   VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  started_at DATETIME(6) NOT NULL COMMENT '所有を始めた日時',
+  ended_at   DATETIME(6) NULL COMMENT '移管して所有が終わった日時',
+  PRIMARY KEY (chair_id, started_at),
+  INDEX (owner_id)
+)
+  COMMENT = '移管された椅子の所有期間テーブル。移管されたことの無い椅子は行を持たず、登録時から今のオーナーのものとする';
+
+DROP TABLE IF EXISTS chair_maintenance_windows;
+CREATE TABLE chair_maintenance_windows
+(
+  id          VARCHAR(26) NOT NULL COMMENT 'メンテナンスID',
+  chair_id    VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  starts_at   DATETIME(6) NOT NULL COMMENT '開始日時',
+  ends_at     DATETIME(6) NOT NULL COMMENT '終了日時',
+  reason      TEXT        NULL COMMENT '理由',
+  created_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  canceled_at DATETIME(6) NULL COMMENT '取り消し日時',
+  PRIMARY KEY (id),
+  INDEX (chair_id, starts_at)
+)
+  COMMENT = '椅子のメンテナンス予定テーブル';
+
+DROP TABLE IF EXISTS chair_pending_deactivations;
+CREATE TABLE chair_pending_deactivations
+(
+  chair_id   VARCHAR(26)                          NOT NULL COMMENT '椅子ID',
+  reason     ENUM ('requested', 'forced_break')   NOT NULL DEFAULT 'requested' COMMENT '椅子からの要求か、勤務時間の上限による休憩か',
+  created_at DATETIME(6)                          NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '受付停止を要求した日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = 'ライドが終わるまで受付停止を待っている椅子のテーブル';
+
+DROP TABLE IF EXISTS chair_shifts;
+CREATE TABLE chair_shifts
+(
+  id         VARCHAR(26)                                      NOT NULL COMMENT 'シフトID',
+  chair_id   VARCHAR(26)                                      NOT NULL COMMENT '椅子ID',
+  started_at DATETIME(6)                                      NOT NULL COMMENT '受付を始めた日時',
+  ended_at   DATETIME(6)                                      NULL COMMENT '受付を止めた日時',
+  end_reason ENUM ('deactivated', 'forced_break', 'retired') NULL COMMENT '止めた理由',
+  PRIMARY KEY (id),
+  INDEX (chair_id, started_at)
+)
+  COMMENT = '椅子が受付をしていた期間のテーブル';
+
+DROP TABLE IF EXISTS chair_audit_logs;
+CREATE TABLE chair_audit_logs
+(
+  id           VARCHAR(26) NOT NULL COMMENT 'ログID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id     VARCHAR(26) NOT NULL COMMENT '操作したオーナーのID',
+  staff_id     VARCHAR(26) NULL COMMENT '操作したスタッフのID',
+  action       ENUM ('rename', 'change_model', 'deactivate', 'retire', 'transfer', 'rotate_token', 'change_service_areas') NOT NULL COMMENT '操作',
+  before_value TEXT        NULL COMMENT '変更前の値',
+  after_value  TEXT        NULL COMMENT '変更後の値',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '操作日時',
+  PRIMARY KEY (id),
+  INDEX (chair_id, created_at)
+)
+  COMMENT = '椅子の変更履歴テーブル';
+
+DROP TABLE IF EXISTS chair_authentications;
+CREATE TABLE chair_authentications
+(
+  id               VARCHAR(26) NOT NULL COMMENT '記録ID',
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  remote_addr      VARCHAR(45) NOT NULL COMMENT '接続元のIPアドレス',
+  authenticated_at DATETIME(6) NOT NULL COMMENT '認証日時',
+  PRIMARY KEY (id),
+  INDEX (chair_id, authenticated_at),
+  INDEX (authenticated_at)
+)
+  COMMENT = '椅子の認証の記録テーブル';
+
+DROP TABLE IF EXISTS service_areas;
+CREATE TABLE service_areas
+(
+  id         VARCHAR(26)                    NOT NULL COMMENT 'サービスエリアID',
+  name       VARCHAR(64)                    NOT NULL COMMENT 'サービスエリア名',
+  shape      ENUM ('rectangle', 'polygon') NOT NULL COMMENT '形',
+  vertices   JSON                           NOT NULL COMMENT '頂点の座標の配列。矩形は対角の2点',
+  created_at DATETIME(6)                    NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'サービスエリアテーブル';
+
+DROP TABLE IF EXISTS chair_service_areas;
+CREATE TABLE chair_service_areas
+(
+  chair_id        VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  service_area_id VARCHAR(26) NOT NULL COMMENT 'サービスエリアID',
+  created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (chair_id, service_area_id)
+)
+  COMMENT = '椅子ごとの営業エリアテーブル';
+
+DROP TABLE IF EXISTS chair_area_violations;
+CREATE TABLE chair_area_violations
+(
+  id         VARCHAR(26) NOT NULL COMMENT 'ID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  latitude   INTEGER     NOT NULL COMMENT 'エリア外で最初に報告された緯度',
+  longitude  INTEGER     NOT NULL COMMENT 'エリア外で最初に報告された経度',
+  started_at DATETIME(6) NOT NULL COMMENT 'エリア外に出た日時',
+  ended_at   DATETIME(6) NULL COMMENT 'エリア内に戻った日時',
+  PRIMARY KEY (id),
+  INDEX (chair_id, started_at)
+)
+  COMMENT = '椅子が営業エリアの外から位置を報告していた期間のテーブル';
+
 DROP TABLE IF EXISTS chair_locations;
 CREATE TABLE chair_locations
 (
@@ -46,22 +170,11 @@ CREATE TABLE chair_locations
   latitude   INTEGER     NOT NULL COMMENT '経度',
   longitude  INTEGER     NOT NULL COMMENT '緯度',
   created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
-  PRIMARY KEY (id)
+  PRIMARY KEY (id),
+  INDEX (chair_id, created_at)
 )
   COMMENT = '椅子の現在位置情報テーブル';
 
-DROP TABLE IF EXISTS latest_chair_locations;
-CREATE TABLE latest_chair_locations
-(
-    chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
-    latitude   INTEGER     NOT NULL COMMENT '経度',
-    longitude  INTEGER     NOT NULL COMMENT '緯度',
-    total_distance INTEGER NOT NULL COMMENT '総移動距離',
-    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
-    PRIMARY KEY (chair_id)
-)
-    COMMENT = '椅子の現在位置情報と総移動距離テーブル';
-
 DROP TABLE IF EXISTS users;
 CREATE TABLE users
 (
@@ -81,6 +194,16 @@ CREATE TABLE users
 )
   COMMENT = '利用者情報テーブル';
 
+DROP TABLE IF EXISTS user_deactivations;
+CREATE TABLE user_deactivations
+(
+  user_id    VARCHAR(26)  NOT NULL COMMENT 'ユーザーID',
+  reason     VARCHAR(255) NOT NULL COMMENT '退会理由',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '退会日時',
+  PRIMARY KEY (user_id)
+)
+  COMMENT = '退会したユーザーのテーブル';
+
 DROP TABLE IF EXISTS payment_tokens;
 CREATE TABLE payment_tokens
 (
@@ -110,6 +233,114 @@ CREATE TABLE rides
 )
   COMMENT = 'ライド情報テーブル';
 
+DROP TABLE IF EXISTS ride_fares;
+CREATE TABLE ride_fares
+(
+  ride_id           VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  base_fare         INTEGER      NOT NULL COMMENT '初乗り運賃',
+  distance          INTEGER      NOT NULL COMMENT '運賃計算に使った距離',
+  fare_per_distance INTEGER      NOT NULL COMMENT '距離あたりの運賃',
+  metered_fare      INTEGER      NOT NULL COMMENT '距離運賃',
+  coupon_code       VARCHAR(255) NULL COMMENT '適用したクーポンコード',
+  discount          INTEGER      NOT NULL COMMENT '割引額',
+  discount_funded_by ENUM ('platform', 'owner') NULL COMMENT '割引の負担者',
+  surcharge         INTEGER      NOT NULL DEFAULT 0 COMMENT '追加料金',
+  fare              INTEGER      NOT NULL COMMENT '請求額',
+  distance_basis    ENUM ('straight', 'measured') NOT NULL DEFAULT 'straight' COMMENT '距離を直線距離と実測距離のどちらで求めたか',
+  created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドの運賃内訳テーブル';
+
+DROP TABLE IF EXISTS ride_measurements;
+CREATE TABLE ride_measurements
+(
+  ride_id             VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  enroute_distance    INTEGER     NOT NULL DEFAULT 0 COMMENT '配車位置に向かう間に移動した距離',
+  enroute_duration    BIGINT      NULL COMMENT '配車位置に着くまでにかかった時間(ミリ秒)',
+  carrying_distance   INTEGER     NOT NULL DEFAULT 0 COMMENT 'ユーザーを乗せて移動した距離',
+  carrying_duration   BIGINT      NULL COMMENT '目的地に着くまでにかかった時間(ミリ秒)',
+  updated_at          DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = '椅子の位置情報から測ったライドの距離と時間のテーブル';
+
+DROP TABLE IF EXISTS ride_payments;
+CREATE TABLE ride_payments
+(
+  ride_id        VARCHAR(26)                       NOT NULL COMMENT 'ライドID',
+  kind           ENUM ('fare', 'tip')              NOT NULL COMMENT '決済の種類',
+  amount         INTEGER                           NOT NULL COMMENT '決済額',
+  payment_method VARCHAR(30)                       NOT NULL COMMENT '支払い方法',
+  token_suffix   VARCHAR(4)                        NOT NULL COMMENT '決済トークンの末尾',
+  status         ENUM ('succeeded', 'failed', 'refunded') NOT NULL COMMENT '決済状況',
+  sales_bucket_start DATETIME(6)                   NULL COMMENT '売上を計上した1時間単位の集計期間の開始日時',
+  created_at     DATETIME(6)                       NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at     DATETIME(6)                       NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id, kind)
+)
+  COMMENT = 'ライドの決済記録テーブル';
+
+DROP TABLE IF EXISTS chair_sales_hourly;
+CREATE TABLE chair_sales_hourly
+(
+  chair_id         VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  bucket_start     DATETIME(6) NOT NULL COMMENT '集計期間の開始日時(1時間単位)',
+  rides            INTEGER     NOT NULL COMMENT '完了したライド数',
+  revenue          INTEGER     NOT NULL COMMENT '手数料を引く前のオーナーの売上',
+  evaluation_total INTEGER     NOT NULL COMMENT '評価の合計',
+  evaluation_count INTEGER     NOT NULL COMMENT '評価の件数',
+  PRIMARY KEY (chair_id, bucket_start),
+  INDEX (bucket_start)
+)
+  COMMENT = '椅子ごとの1時間単位の売上集計テーブル';
+
+DROP TABLE IF EXISTS payout_statements;
+CREATE TABLE payout_statements
+(
+  id                VARCHAR(26) NOT NULL COMMENT '明細ID',
+  owner_id          VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  period_start      DATETIME(6) NOT NULL COMMENT '対象期間の開始日時',
+  period_end        DATETIME(6) NOT NULL COMMENT '対象期間の終了日時(この日時を含まない)',
+  rides             INTEGER     NOT NULL COMMENT '完了したライド数',
+  gross_fare        INTEGER     NOT NULL COMMENT '割引前の運賃の合計',
+  platform_discount INTEGER     NOT NULL COMMENT 'プラットフォーム負担の割引',
+  owner_discount    INTEGER     NOT NULL COMMENT 'オーナー負担の割引',
+  charged           INTEGER     NOT NULL COMMENT '決済された額',
+  refunds           INTEGER     NOT NULL COMMENT '期間内のライドの返金',
+  platform_fee      INTEGER     NOT NULL COMMENT 'プラットフォームの手数料',
+  net               INTEGER     NOT NULL COMMENT '手数料を引いたオーナーの売上',
+  refund_adjustment INTEGER     NOT NULL COMMENT '締め済みの期間のライドの返金による差し引き',
+  tips              INTEGER     NOT NULL COMMENT 'チップ',
+  payout            INTEGER     NOT NULL COMMENT '支払額',
+  created_at        DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '締め日時',
+  PRIMARY KEY (id),
+  UNIQUE (owner_id, period_start)
+)
+  COMMENT = 'オーナーへの支払明細テーブル';
+
+DROP TABLE IF EXISTS payout_statement_items;
+CREATE TABLE payout_statement_items
+(
+  statement_id      VARCHAR(26) NOT NULL COMMENT '明細ID',
+  chair_id          VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  chair_name        VARCHAR(30) NOT NULL COMMENT '締め時点の椅子の名前',
+  chair_model       TEXT        NOT NULL COMMENT '締め時点の椅子のモデル',
+  rides             INTEGER     NOT NULL COMMENT '完了したライド数',
+  gross_fare        INTEGER     NOT NULL COMMENT '割引前の運賃の合計',
+  platform_discount INTEGER     NOT NULL COMMENT 'プラットフォーム負担の割引',
+  owner_discount    INTEGER     NOT NULL COMMENT 'オーナー負担の割引',
+  charged           INTEGER     NOT NULL COMMENT '決済された額',
+  refunds           INTEGER     NOT NULL COMMENT '期間内のライドの返金',
+  platform_fee      INTEGER     NOT NULL COMMENT 'プラットフォームの手数料',
+  net               INTEGER     NOT NULL COMMENT '手数料を引いたオーナーの売上',
+  refund_adjustment INTEGER     NOT NULL COMMENT '締め済みの期間のライドの返金による差し引き',
+  tips              INTEGER     NOT NULL COMMENT 'チップ',
+  payout            INTEGER     NOT NULL COMMENT '支払額',
+  PRIMARY KEY (statement_id, chair_id)
+)
+  COMMENT = 'オーナーへの支払明細の椅子ごとの内訳テーブル';
+
 DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses
 (
@@ -140,6 +371,25 @@ CREATE TABLE latest_ride_statuses
     )
         COMMENT = 'ライドステータスの変更履歴(最新)テーブル';
 
+DROP TABLE IF EXISTS ride_assignments;
+CREATE TABLE ride_assignments
+(
+  id                VARCHAR(26)                              NOT NULL COMMENT '割り当てID',
+  ride_id           VARCHAR(26)                              NOT NULL COMMENT 'ライドID',
+  chair_id          VARCHAR(26)                              NOT NULL COMMENT '椅子ID',
+  result            ENUM ('accepted', 'rejected', 'timeout') NULL COMMENT '椅子の応答',
+  reason            TEXT                                     NULL COMMENT '断った理由',
+  assigned_at       DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '割り当て日時',
+  ack_deadline      DATETIME(6)                              NOT NULL COMMENT '応答期限',
+  responded_at      DATETIME(6)                              NULL COMMENT '応答日時',
+  chair_notified_at DATETIME(6)                              NULL COMMENT '割り当ての取り消しを椅子に通知した日時',
+  PRIMARY KEY (id),
+  INDEX (ride_id, chair_id),
+  INDEX (chair_id, assigned_at),
+  INDEX (result, ack_deadline)
+)
+  COMMENT = 'ライドの椅子への割り当て履歴テーブル';
+
 DROP TABLE IF EXISTS owners;
 CREATE TABLE owners
 (
@@ -156,6 +406,63 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS owner_staffs;
+CREATE TABLE owner_staffs
+(
+  id           VARCHAR(26)                            NOT NULL COMMENT 'スタッフID',
+  owner_id     VARCHAR(26)                            NOT NULL COMMENT 'オーナーID',
+  name         VARCHAR(30)                            NOT NULL COMMENT 'スタッフ名',
+  role         ENUM ('viewer', 'dispatcher', 'admin') NOT NULL COMMENT '権限',
+  access_token VARCHAR(255)                           NOT NULL COMMENT 'アクセストークン',
+  created_at   DATETIME(6)                            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at   DATETIME(6)                            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (access_token),
+  INDEX (owner_id)
+)
+  COMMENT = 'オーナーのスタッフ情報テーブル';
+
+DROP TABLE IF EXISTS owner_rating_alert_settings;
+CREATE TABLE owner_rating_alert_settings
+(
+  owner_id    VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  threshold   DOUBLE       NOT NULL COMMENT 'この値を下回ったら通知する平均評価',
+  window_size INTEGER      NOT NULL COMMENT '平均を取る直近の評価の件数',
+  notify_url  VARCHAR(255) NULL COMMENT '通知先のURL',
+  updated_at  DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (owner_id)
+)
+  COMMENT = 'オーナーの低評価通知の設定テーブル';
+
+DROP TABLE IF EXISTS owner_shift_limits;
+CREATE TABLE owner_shift_limits
+(
+  owner_id               VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  max_continuous_minutes INTEGER     NOT NULL COMMENT '続けて受付できる時間の上限(分)。0 なら上限なし',
+  min_break_minutes      INTEGER     NOT NULL COMMENT 'これより短い休憩は受付を続けているものとみなす(分)',
+  updated_at             DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (owner_id)
+)
+  COMMENT = 'オーナーの椅子の勤務時間の上限テーブル';
+
+DROP TABLE IF EXISTS chair_rating_alerts;
+CREATE TABLE chair_rating_alerts
+(
+  id           VARCHAR(26) NOT NULL COMMENT '通知ID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  owner_id     VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  average      DOUBLE      NOT NULL COMMENT '通知時点の直近の平均評価',
+  threshold    DOUBLE      NOT NULL COMMENT '通知時点の閾値',
+  window_size  INTEGER     NOT NULL COMMENT '通知時点の平均を取った件数',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発生日時',
+  delivered_at DATETIME(6) NULL COMMENT '通知先に届けた日時',
+  resolved_at  DATETIME(6) NULL COMMENT '平均評価が閾値以上に戻った日時',
+  PRIMARY KEY (id),
+  INDEX (owner_id, created_at),
+  INDEX (chair_id, resolved_at)
+)
+  COMMENT = '椅子の低評価の通知テーブル';
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
@@ -170,25 +477,27 @@ CREATE TABLE coupons
 )
   COMMENT 'クーポンテーブル';
 
-DELIMITER $$
-
-CREATE TRIGGER update_latest_chair_locations
-    AFTER INSERT ON chair_locations
-    FOR EACH ROW
-BEGIN
-    -- 更新対象のchair_idがすでにlatest_chair_locationsに存在するか確認し、挿入または更新
-    INSERT INTO latest_chair_locations (chair_id, latitude, longitude, total_distance, created_at)
-    VALUES (NEW.chair_id, NEW.latitude, NEW.longitude, 0, NEW.created_at)
-        ON DUPLICATE KEY UPDATE
-                             total_distance = total_distance +
-                             IF(latitude IS NOT NULL AND longitude IS NOT NULL,
-                             ABS(latitude - NEW.latitude) + ABS(longitude - NEW.longitude), 0),
-                             latitude = NEW.latitude,
-                             longitude = NEW.longitude,
-                             created_at = NEW.created_at;
-    END$$
-
-    DELIMITER ;
+DROP TABLE IF EXISTS campaigns;
+CREATE TABLE campaigns
+(
+  id              VARCHAR(26)                                                    NOT NULL COMMENT 'キャンペーンID',
+  name            VARCHAR(255)                                                   NOT NULL COMMENT 'キャンペーン名',
+  code_pattern    VARCHAR(255)                                                   NOT NULL COMMENT 'クーポンコードのパターン(末尾*で前方一致)',
+  grant_on        ENUM ('signup', 'invitation', 'invitation_reward', 'promo')    NOT NULL COMMENT '付与契機',
+  discount_type   ENUM ('fixed', 'percent')                                      NOT NULL COMMENT '割引種別',
+  discount_value  INTEGER                                                        NOT NULL COMMENT '割引額または割引率(%)',
+  discount_cap    INTEGER                                                        NULL COMMENT '割引額の上限',
+  starts_at       DATETIME(6)                                                    NULL COMMENT '有効期間の開始日時',
+  ends_at         DATETIME(6)                                                    NULL COMMENT '有効期間の終了日時',
+  max_redemptions INTEGER                                                        NULL COMMENT '同一コードの最大付与数',
+  per_user_limit  INTEGER                                                        NULL COMMENT 'ユーザーごとの最大付与数',
+  priority        INTEGER                                                        NOT NULL DEFAULT 0 COMMENT '適用優先度(大きいほど優先)',
+  funded_by       ENUM ('platform', 'owner')                                     NOT NULL DEFAULT 'platform' COMMENT '割引の負担者',
+  created_at      DATETIME(6)                                                    NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX (grant_on)
+)
+  COMMENT 'クーポンキャンペーンテーブル';
 
 DELIMITER $$
 
@@ -4,7 +4,13 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 USE isuride;
 
 INSERT INTO settings (name, value)
-VALUES ('payment_gateway_url', 'http://localhost:12345');
+VALUES ('payment_gateway_url', 'http://localhost:12345'),
+       ('platform_fee_percent', '10'),
+       ('payout_period', 'week'),
+       ('chair_offline_after_seconds', '30'),
+       ('chair_ack_timeout_seconds', '30'),
+       ('fare_distance_basis', 'straight'),
+       ('chair_move_interval_ms', '1000');
 
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
@@ -62,3 +68,8 @@ VALUES ('リラックスシート NEO', 2),
        ('タイタンフレーム ULTRA', 7),
        ('ヴァーチェア SUPREME', 7),
        ('オブシディアン PRIME', 7);
+
+INSERT INTO campaigns (id, name, code_pattern, grant_on, discount_type, discount_value, max_redemptions, per_user_limit, priority, created_at)
+VALUES ('01JDFEDF00A56M161V6JAJXAXB', '初回登録キャンペーン', 'CP_NEW2024', 'signup', 'fixed', 3000, NULL, 1, 100, '2024-11-24 16:00:00.000000'),
+       ('01JDFEDF00A56M161V6MPS8N9K', '招待キャンペーン', 'INV_*', 'invitation', 'fixed', 1500, 3, 1, 0, '2024-11-24 16:00:00.000000'),
+       ('01JDFEDF00A56M161V6NC3Y5SE', '招待報酬キャンペーン', 'RWD_*', 'invitation_reward', 'fixed', 1000, NULL, NULL, 0, '2024-11-24 16:00:00.000000');